@@ -1,5 +1,3 @@
-//go:build windows
-
 package main
 
 import (
@@ -24,28 +22,28 @@ type AccountEnt struct {
 	LastTime  int64
 }
 
-func (e *AccountEnt) String() string {
-	return fmt.Sprintf("type=Account,subject=%s,target=%s,computer=%s,count=%d,edit=%d,password=%d,other=%d,ft=%s,lt=%s",
-		e.Subject, e.Target, e.Computer, e.Count, e.Edit, e.Password, e.Other,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339),
+func (e *AccountEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Account", "subject", e.Subject, "target", e.Target, "computer", e.Computer,
+		"count", e.Count, "edit", e.Edit, "password", e.Password, "other", e.Other,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
 	)
 }
 
 var AccountMap sync.Map
 
-func updateAccount(s *System, l string, t time.Time) {
-	subjectUserName := getEventData(reSubjectUserName, l)
-	subjectDomainName := getEventData(reSubjectDomainName, l)
-	targetUserName := getEventData(reTargetUserName, l)
-	targetDomainName := getEventData(reTargetDomainName, l)
+func updateAccount(ev *Event, t time.Time) {
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
+	targetUserName := ev.Get("TargetUserName")
+	targetDomainName := ev.Get("TargetDomainName")
 	ts := t.Unix()
 	target := fmt.Sprintf("%s@%s", targetUserName, targetDomainName)
 	subject := fmt.Sprintf("%s@%s", subjectUserName, subjectDomainName)
-	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s", subject, target, s.Computer))
+	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s", subject, target, ev.System.Computer))
 	if v, ok := AccountMap.Load(id); ok {
 		if e, ok := v.(*AccountEnt); ok {
-			incAcountEnt(e, s.EventID)
+			incAcountEnt(e, ev.System.EventID)
 			if e.LastTime < ts {
 				e.LastTime = ts
 			}
@@ -54,13 +52,13 @@ func updateAccount(s *System, l string, t time.Time) {
 	}
 	e := &AccountEnt{
 		Subject:   subject,
-		Computer:  s.Computer,
+		Computer:  ev.System.Computer,
 		Count:     0,
 		Target:    target,
 		LastTime:  ts,
 		FirstTime: ts,
 	}
-	incAcountEnt(e, s.EventID)
+	incAcountEnt(e, ev.System.EventID)
 	AccountMap.Store(id, e)
 }
 
@@ -82,11 +80,11 @@ func sendAccount() {
 			if debug {
 				log.Printf("account id=%s,e=%v", k, e)
 			}
-			accountCount++
+			accountCount.Add(1)
 			sendSyslog(&syslogEnt{
 				Severity: 6,
 				Time:     time.Now(),
-				Msg:      e.String(),
+				Fields:   e.Fields(),
 			})
 			publishMQTT(&mqttAccountDataEnt{
 				Time:      time.Now().Format(time.RFC3339),
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var alertCount atomic.Int64
+
+// sendAlert : 検知した脅威をsyslogはCRIT、MQTTは/Alertで送信する
+// kvは"ip", ip, "accounts", n, ...の順に指定する
+func sendAlert(alert, computer string, t time.Time, kv ...interface{}) {
+	alertCount.Add(1)
+	f := newSyslogFields("type", "Alert", "alert", alert, "computer", computer)
+	f = append(f, newSyslogFields(kv...)...)
+	f = append(f, newSyslogFields("time", t.Format(time.RFC3339))...)
+	msg := f.String()
+	if debug {
+		log.Println(msg)
+	}
+	sendSyslog(&syslogEnt{
+		Severity: 2,
+		Time:     t,
+		Msg:      msg,
+		Fields:   f,
+	})
+	m := make(map[string]string)
+	for _, e := range f[3:] {
+		m[e.Key] = e.Value
+	}
+	publishMQTT(&mqttAlertDataEnt{
+		Time:     t.Format(time.RFC3339),
+		Level:    "CRIT",
+		Alert:    alert,
+		Computer: computer,
+		Message:  msg,
+		Fields:   m,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 実行中の状態の確認と操作のためのAPI
+
+type apiStatusEnt struct {
+	Version       string              `json:"version"`
+	StartTime     string              `json:"start_time"`
+	Uptime        int64               `json:"uptime"`
+	Replay        bool                `json:"replay"`
+	LastEventTime string              `json:"last_event_time"`
+	Remotes       []apiRemoteEnt      `json:"remotes"`
+	Syslog        []syslogDstStatsEnt `json:"syslog"`
+	MQTT          *apiMQTTEnt         `json:"mqtt,omitempty"`
+	Spooled       int64               `json:"spooled"`
+	Queued        int64               `json:"queued"`
+	Dropped       int64               `json:"dropped"`
+}
+
+type apiRemoteEnt struct {
+	Remote       string           `json:"remote"`
+	LastTime     string           `json:"last_time"`
+	Bookmarks    map[string]int64 `json:"bookmarks"`
+	PollTime     string           `json:"poll_time"`
+	PollDuration float64          `json:"poll_duration"`
+	Events       int64            `json:"events"`
+}
+
+type apiMQTTEnt struct {
+	Broker    string `json:"broker"`
+	Connected bool   `json:"connected"`
+	Queue     int    `json:"queue"`
+}
+
+// apiAggregateMaps : /aggregates/{type}で参照する集計
+var apiAggregateMaps = map[string]*sync.Map{
+	"eventid":         &eventIDMap,
+	"account":         &AccountMap,
+	"kerberos":        &kerberosMap,
+	"privilege":       &privilegeMap,
+	"process":         &processMap,
+	"processinstance": &processInstanceMap,
+	"task":            &taskMap,
+	"service":         &serviceMap,
+	"group":           &groupMap,
+	"session":         &sessionMap,
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("api err=%v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func formatAPITime(ts int64) string {
+	if ts < 1 {
+		return ""
+	}
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getStatus())
+}
+
+// getStatus : /statusとMQTTのstatusコマンドで返す状態
+func getStatus() *apiStatusEnt {
+	eventMu.Lock()
+	last := lastEventTime
+	eventMu.Unlock()
+	st := &apiStatusEnt{
+		Version:       version + "(" + commit + ")",
+		StartTime:     startTime.Format(time.RFC3339),
+		Uptime:        int64(time.Since(startTime).Seconds()),
+		Replay:        isReplay(),
+		LastEventTime: formatAPITime(last),
+		Remotes:       []apiRemoteEnt{},
+		Syslog:        getSyslogDstStats(),
+	}
+	for _, rm := range remoteList {
+		e := apiRemoteEnt{
+			Remote:       rm.key(),
+			Bookmarks:    getBookmarks(rm.key()),
+			PollTime:     formatAPITime(rm.pollTime.Load()),
+			PollDuration: time.Duration(rm.pollDuration.Load()).Seconds(),
+			Events:       rm.pollEvents.Load(),
+		}
+		if t, ok := getStateLastTime(rm.key()); ok {
+			e.LastTime = t.Format(time.RFC3339)
+		}
+		st.Remotes = append(st.Remotes, e)
+	}
+	if mqttDst != "" {
+		st.MQTT = &apiMQTTEnt{
+			Broker:    mqttDst,
+			Connected: mqttConnected.Load(),
+			Queue:     getMQTTQueueLen(),
+		}
+	}
+	st.Spooled, st.Queued, st.Dropped = getSpoolStats()
+	return st
+}
+
+// aggregatesHandler : 送信前の集計をキーの順に返す
+func aggregatesHandler(w http.ResponseWriter, r *http.Request) {
+	t := r.PathValue("type")
+	m, ok := apiAggregateMaps[strings.ToLower(t)]
+	if !ok {
+		types := []string{}
+		for k := range apiAggregateMaps {
+			types = append(types, k)
+		}
+		sort.Strings(types)
+		writeAPIError(w, http.StatusNotFound, "unknown type "+t+" ("+strings.Join(types, ",")+")")
+		return
+	}
+	keys := []string{}
+	values := make(map[string]interface{})
+	// 集計はイベントの処理中に変更されるのでロックしたままJSONにする
+	eventMu.Lock()
+	m.Range(func(k, v interface{}) bool {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+			values[s] = v
+		}
+		return true
+	})
+	sort.Strings(keys)
+	list := []interface{}{}
+	for _, k := range keys {
+		list = append(list, values[k])
+	}
+	b, err := json.Marshal(list)
+	eventMu.Unlock()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// flushHandler : 集計をすぐに送信する
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("api flush")
+	if !sendReport(getRemoteParam()) {
+		writeAPIError(w, http.StatusConflict, "send report busy")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+}
+
+// reloadHandler : 設定ファイルとSigmaルールを再読み込みする
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("api reload")
+	if err := reloadConfig(); err != nil {
+		log.Printf("reload err=%v", err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+}
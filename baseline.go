@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 親子プロセスとユーザーの組み合わせを学習して初めて見た組み合わせを検知する
+
+// lolbinList : 親に関係なく初めて見た時にアラートにする子プロセス
+var lolbinList = []string{
+	"powershell.exe", "pwsh.exe", "mshta.exe", "wscript.exe", "cscript.exe",
+	"rundll32.exe", "regsvr32.exe", "certutil.exe", "bitsadmin.exe", "msbuild.exe",
+	"installutil.exe", "regasm.exe", "regsvcs.exe", "cmstp.exe", "msiexec.exe",
+	"wmic.exe", "forfiles.exe", "hh.exe", "odbcconf.exe", "msxsl.exe",
+	"psexec.exe", "ntdsutil.exe", "vssadmin.exe", "bcdedit.exe", "wevtutil.exe",
+}
+
+// checkProcessBaseline : 4688の親、子、ユーザーの組み合わせを状態ファイルに保存する
+// 学習期間の後は初めての組み合わせ、LOLBinは学習期間中でもアラートにする
+func checkProcessBaseline(ev *Event, t time.Time) {
+	child := getImageName(ev.Get("NewProcessName"))
+	parent := getImageName(ev.Get("ParentProcessName"))
+	if child == "" {
+		return
+	}
+	user := strings.ToLower(ev.Get("SubjectUserName") + "@" + ev.Get("SubjectDomainName"))
+	computer := strings.ToUpper(ev.System.Computer)
+	ts := t.Unix()
+	// 学習期間はコンピュータを初めて見た時から数える
+	setFirstSeen("processLearn", computer, ts)
+	if !setFirstSeen("processTree", computer+"|"+parent+"|"+child+"|"+user, ts) {
+		return
+	}
+	alert := ""
+	if isLOLBin(child) {
+		alert = "SuspiciousProcess"
+	} else if start, ok := getFirstSeen("processLearn", computer); ok && ts-start >= int64(learnPeriod)*3600 {
+		alert = "NewProcessTree"
+	}
+	if alert == "" {
+		return
+	}
+	sendAlert(alert, ev.System.Computer, t,
+		"parent", parent, "child", child, "user", user,
+		"process", ev.Get("NewProcessName"), "commandLine", ev.Get("CommandLine"),
+		"pid", ev.Get("NewProcessId"), "ppid", ev.Get("ProcessId"))
+}
+
+// getImageName : C:\Windows\System32\cmd.exe -> cmd.exe
+func getImageName(s string) string {
+	if s == "" {
+		return ""
+	}
+	return strings.ToLower(filepath.Base(strings.ReplaceAll(s, "\\", "/")))
+}
+
+func isLOLBin(name string) bool {
+	for _, l := range lolbinList {
+		if strings.EqualFold(l, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeProcessEvent(rec int, ts, parent, child, user string) string {
+	return makeReplayEvent(4688, rec, ts, map[string]string{
+		"NewProcessId":      fmt.Sprintf("0x%x", rec),
+		"ProcessId":         "0x10",
+		"NewProcessName":    `C:\Windows\System32\` + child,
+		"ParentProcessName": `C:\Program Files\` + parent,
+		"SubjectUserName":   user,
+		"SubjectDomainName": "CONTOSO",
+	})
+}
+
+func resetFirstSeen() {
+	stateMu.Lock()
+	state.FirstSeen = make(map[string]map[string]int64)
+	stateMu.Unlock()
+}
+
+// 学習期間中はLOLBinだけ、学習期間の後は初めての組み合わせをアラートにすること
+func TestProcessBaseline(t *testing.T) {
+	learnPeriod = 1
+	defer func() {
+		learnPeriod = 168
+		resetFirstSeen()
+		processInstanceMap.Clear()
+	}()
+	resetFirstSeen()
+	drainSyslog()
+	tests := []struct {
+		ts     string
+		parent string
+		child  string
+		user   string
+		alert  string
+	}{
+		{"2025-01-23T08:00:00Z", "explorer.exe", "cmd.exe", "alice", ""},
+		{"2025-01-23T08:10:00Z", "explorer.exe", "powershell.exe", "alice", "SuspiciousProcess"},
+		{"2025-01-23T08:20:00Z", "explorer.exe", "notepad.exe", "alice", ""},
+		{"2025-01-23T08:30:00Z", "explorer.exe", "powershell.exe", "alice", ""},
+		{"2025-01-23T10:00:00Z", "explorer.exe", "cmd.exe", "alice", ""},
+		{"2025-01-23T10:00:01Z", "winword.exe", "cmd.exe", "alice", "NewProcessTree"},
+		{"2025-01-23T10:00:02Z", "winword.exe", "cmd.exe", "bob", "NewProcessTree"},
+		{"2025-01-23T10:00:03Z", "WINWORD.EXE", "CMD.EXE", "Bob", ""},
+		{"2025-01-23T10:00:04Z", "winword.exe", "rundll32.exe", "alice", "SuspiciousProcess"},
+	}
+	for i, tt := range tests {
+		checkEvents(makeProcessEvent(i+1, tt.ts, tt.parent, tt.child, tt.user))
+		alert := ""
+		for _, m := range drainSyslog() {
+			if strings.Contains(m, "type=Alert") {
+				if alert != "" {
+					t.Errorf("%d two alerts", i)
+				}
+				alert = m
+			}
+		}
+		if tt.alert == "" {
+			if alert != "" {
+				t.Errorf("%d %s>%s alert %s", i, tt.parent, tt.child, alert)
+			}
+			continue
+		}
+		if !strings.Contains(alert, "alert="+tt.alert) || !strings.Contains(alert, "parent="+tt.parent) ||
+			!strings.Contains(alert, "child="+tt.child) || !strings.Contains(alert, "user="+tt.user+"@contoso") {
+			t.Errorf("%d %s>%s alert=%q want %s", i, tt.parent, tt.child, alert, tt.alert)
+		}
+	}
+	if ts, ok := getFirstSeen("processTree", "DC01.CONTOSO.LOCAL|explorer.exe|cmd.exe|alice@contoso"); !ok || ts != 1737619200 {
+		t.Errorf("first seen=%d,%v", ts, ok)
+	}
+	if ts, ok := getFirstSeen("processLearn", "DC01.CONTOSO.LOCAL"); !ok || ts != 1737619200 {
+		t.Errorf("learn start=%d,%v", ts, ok)
+	}
+}
+
+// process.learn: 0は学習しないで初めての組み合わせをアラートにすること
+func TestProcessBaselineNoLearn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twwinlog.yaml")
+	if err := os.WriteFile(path, []byte("process:\n  learn: 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		learnPeriod = 168
+		resetFirstSeen()
+		processInstanceMap.Clear()
+	}()
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if learnPeriod != 0 {
+		t.Fatalf("learnPeriod=%d", learnPeriod)
+	}
+	resetFirstSeen()
+	drainSyslog()
+	checkEvents(makeProcessEvent(1, "2025-01-23T08:00:00Z", "explorer.exe", "cmd.exe", "alice"))
+	found := false
+	for _, m := range drainSyslog() {
+		if strings.Contains(m, "alert=NewProcessTree") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("no NewProcessTree alert without learning")
+	}
+	if err := os.WriteFile(path, []byte("process:\n  learn: -1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path); err == nil {
+		t.Error("no error for negative learn")
+	}
+}
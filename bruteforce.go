@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// ログオンとKerberosの認証失敗からパスワードスプレーとブルートフォースを検知する
+
+type authFailEnt struct {
+	Time    int64
+	Account string
+	IP      string
+	Code    string
+}
+
+// authFailByIP : 送信元IPごとの失敗。多くのアカウントに失敗したらスプレー
+var authFailByIP = make(map[string][]authFailEnt)
+
+// authFailByAccount : アカウントごとの失敗。何度も失敗したらブルートフォース
+var authFailByAccount = make(map[string][]authFailEnt)
+
+// authAlertTime : 同じ送信元とアカウントのアラートは時間枠の間に一度だけ送信する
+var authAlertTime = make(map[string]int64)
+
+// checkAuthEvent : checkEventsの中から呼び出す。logonとkerberosのハンドラーとは関係なく検知する
+func checkAuthEvent(ev *Event, t time.Time) {
+	switch ev.System.EventID {
+	case 4625:
+		checkAuthFailure(ev.System.Computer, ev.Get("TargetUserName"), ev.Get("IpAddress"), getFailedCode(ev.Get("SubStatus")), t)
+	case 4768, 4769, 4771:
+		checkAuthFailure(ev.System.Computer, ev.Get("TargetUserName"), ev.Get("IpAddress"), getKerberosFailCode(ev.Get("Status")), t)
+	case 4776:
+		// NTLMの認証には送信元IPがないのでブルートフォースだけ数える
+		checkAuthFailure(ev.System.Computer, ev.Get("TargetUserName"), "", getFailedCode(ev.Get("Status")), t)
+	}
+}
+
+// checkAuthFailure : codeはgetFailedCodeかgetKerberosFailCodeの値
+func checkAuthFailure(computer, user, ip, code string, t time.Time) {
+	kind := getAuthFailKind(code)
+	if kind == "" {
+		return
+	}
+	ts := t.Unix()
+	ip = strings.TrimPrefix(ip, "::ffff:")
+	account := getAuthFailAccount(user)
+	e := authFailEnt{Time: ts, Account: account, IP: ip, Code: kind}
+	if ip != "" && ip != "127.0.0.1" && ip != "::1" && sprayThreshold > 0 {
+		l := pruneAuthFail(append(authFailByIP[ip], e), ts)
+		authFailByIP[ip] = l
+		accounts := make(map[string]bool)
+		notFound := 0
+		for _, f := range l {
+			accounts[f.Account] = true
+			if f.Code == "UserNotFound" {
+				notFound++
+			}
+		}
+		if len(accounts) >= sprayThreshold && checkAuthAlertTime("spray:"+ip, ts) {
+			sendAlert("PasswordSpray", computer, t,
+				"ip", ip, "accounts", len(accounts), "failed", len(l), "userNotFound", notFound,
+				"window", detectWindow, "users", joinAuthFailKeys(accounts))
+		}
+	}
+	if account != "" && kind != "UserNotFound" && bruteForceThreshold > 0 {
+		l := pruneAuthFail(append(authFailByAccount[account], e), ts)
+		authFailByAccount[account] = l
+		ips := make(map[string]bool)
+		for _, f := range l {
+			if f.IP != "" {
+				ips[f.IP] = true
+			}
+		}
+		if len(l) >= bruteForceThreshold && checkAuthAlertTime("brute:"+account, ts) {
+			sendAlert("BruteForce", computer, t,
+				"target", user, "failed", len(l), "sources", len(ips),
+				"window", detectWindow, "ips", joinAuthFailKeys(ips))
+		}
+	}
+}
+
+// getAuthFailKind : パスワードの間違いとユーザーが存在しない場合を区別する
+func getAuthFailKind(code string) string {
+	switch code {
+	case "BadPassword":
+		return "BadPassword"
+	case "UserNotFound", "BadUserName":
+		return "UserNotFound"
+	case "Locked", "Account":
+		return "Locked"
+	}
+	return ""
+}
+
+// getAuthFailAccount : user@REALMとDOMAIN\userを4625と同じuserにする
+func getAuthFailAccount(user string) string {
+	user, _, _ = strings.Cut(user, "@")
+	if i := strings.LastIndex(user, "\\"); i >= 0 {
+		user = user[i+1:]
+	}
+	return strings.ToLower(user)
+}
+
+// pruneAuthFail : 複数のリモートと再取得のイベントは時刻順でないので時刻で比較して削除する
+func pruneAuthFail(l []authFailEnt, ts int64) []authFailEnt {
+	r := l[:0]
+	for _, e := range l {
+		if e.Time > ts-int64(detectWindow) {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+func checkAuthAlertTime(key string, ts int64) bool {
+	if lt, ok := authAlertTime[key]; ok && ts-lt < int64(detectWindow) {
+		return false
+	}
+	authAlertTime[key] = ts
+	return true
+}
+
+// joinAuthFailKeys : 最大10件を;で区切る
+func joinAuthFailKeys(m map[string]bool) string {
+	a := []string{}
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	if len(a) > 10 {
+		a = append(a[:10], "...")
+	}
+	return strings.Join(a, ";")
+}
+
+// cleanupAuthFail : 時間枠を過ぎた失敗を削除する
+func cleanupAuthFail() {
+	now := getCheckTime()
+	for _, m := range []map[string][]authFailEnt{authFailByIP, authFailByAccount} {
+		for k, l := range m {
+			if l = pruneAuthFail(l, now); len(l) < 1 {
+				delete(m, k)
+			} else {
+				m[k] = l
+			}
+		}
+	}
+	for k, ts := range authAlertTime {
+		if now-ts >= int64(detectWindow) {
+			delete(authAlertTime, k)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetAuthFail() {
+	authFailByIP = make(map[string][]authFailEnt)
+	authFailByAccount = make(map[string][]authFailEnt)
+	authAlertTime = make(map[string]int64)
+}
+
+func getAlerts(alert string) []string {
+	ret := []string{}
+	for _, m := range drainSyslog() {
+		if strings.Contains(m, "alert="+alert+",") {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+type authEventEnt struct {
+	sec     int
+	eventID int
+	user    string
+	ip      string
+	status  string
+}
+
+func checkTestAuthEvents(l []authEventEnt) {
+	st := time.Date(2025, 1, 23, 8, 0, 0, 0, time.UTC)
+	for _, e := range l {
+		data := map[string]string{"TargetUserName": e.user, "IpAddress": e.ip}
+		if e.eventID == 4625 {
+			data["SubStatus"] = e.status
+		} else {
+			data["Status"] = e.status
+		}
+		checkAuthEvent(newTestEvent("Security", e.eventID, data), st.Add(time.Second*time.Duration(e.sec)))
+	}
+}
+
+func TestBruteForce(t *testing.T) {
+	bruteForceThreshold = 3
+	sprayThreshold = 0
+	defer func() {
+		bruteForceThreshold = 10
+		sprayThreshold = 10
+		resetAuthFail()
+	}()
+	resetAuthFail()
+	drainSyslog()
+	// 4625,4771,4776のユーザー名の形式が違っても同じアカウントとして数える
+	checkTestAuthEvents([]authEventEnt{
+		{0, 4625, "Bob", "10.0.0.1", "0xc000006a"},
+		{1, 4771, "bob@CONTOSO.LOCAL", "::ffff:10.0.0.2", "0x18"},
+		{2, 4625, "alice", "10.0.0.1", "0xc000006a"},
+	})
+	if l := getAlerts("BruteForce"); len(l) != 0 {
+		t.Fatalf("alert before threshold %v", l)
+	}
+	checkTestAuthEvents([]authEventEnt{
+		{3, 4776, `CONTOSO\bob`, "", "0xc000006a"},
+		{4, 4625, "bob", "10.0.0.3", "0xc000006a"},
+	})
+	l := getAlerts("BruteForce")
+	if len(l) != 1 {
+		t.Fatalf("alerts=%v", l)
+	}
+	for _, s := range []string{"target=CONTOSO\\bob", "failed=3", "sources=2", "ips=10.0.0.1;10.0.0.2"} {
+		if !strings.Contains(l[0], s) {
+			t.Errorf("no %s in %s", s, l[0])
+		}
+	}
+	// 成功とユーザーが存在しない失敗は数えない
+	resetAuthFail()
+	checkTestAuthEvents([]authEventEnt{
+		{10, 4625, "carol", "10.0.0.1", "0xc0000064"},
+		{11, 4771, "carol", "10.0.0.1", "0x0"},
+		{12, 4776, "carol", "", "0x0"},
+		{13, 4625, "carol", "10.0.0.1", "0xc000006a"},
+		{14, 4625, "carol", "10.0.0.1", "0xc000006a"},
+	})
+	if l := getAlerts("BruteForce"); len(l) != 0 {
+		t.Errorf("alert for success or user not found %v", l)
+	}
+}
+
+func TestPasswordSpray(t *testing.T) {
+	sprayThreshold = 3
+	bruteForceThreshold = 0
+	defer func() {
+		bruteForceThreshold = 10
+		sprayThreshold = 10
+		resetAuthFail()
+	}()
+	resetAuthFail()
+	drainSyslog()
+	checkTestAuthEvents([]authEventEnt{
+		{0, 4625, "alice", "10.0.0.9", "0xc000006a"},
+		{1, 4625, "Alice", "10.0.0.9", "0xc000006a"},
+		{2, 4771, "bob@CONTOSO.LOCAL", "::ffff:10.0.0.9", "0x18"},
+		{3, 4625, "carol", "10.0.0.8", "0xc000006a"},
+		// NTLMは送信元IPがないのでスプレーには数えない
+		{4, 4776, "dave", "", "0xc000006a"},
+		{5, 4625, "127.0.0.1", "127.0.0.1", "0xc000006a"},
+	})
+	if l := getAlerts("PasswordSpray"); len(l) != 0 {
+		t.Fatalf("alert before threshold %v", l)
+	}
+	checkTestAuthEvents([]authEventEnt{
+		{6, 4625, "nobody", "10.0.0.9", "0xc0000064"},
+		{7, 4625, "eve", "10.0.0.9", "0xc000006a"},
+	})
+	l := getAlerts("PasswordSpray")
+	if len(l) != 1 {
+		t.Fatalf("alerts=%v", l)
+	}
+	for _, s := range []string{"ip=10.0.0.9", "accounts=3", "failed=4", "userNotFound=1", "users=alice;bob;nobody"} {
+		if !strings.Contains(l[0], s) {
+			t.Errorf("no %s in %s", s, l[0])
+		}
+	}
+}
+
+func TestAuthFailWindow(t *testing.T) {
+	bruteForceThreshold = 3
+	detectWindow = 60
+	defer func() {
+		bruteForceThreshold = 10
+		detectWindow = 600
+		resetAuthFail()
+	}()
+	resetAuthFail()
+	drainSyslog()
+	checkTestAuthEvents([]authEventEnt{
+		{0, 4625, "bob", "10.0.0.1", "0xc000006a"},
+		{30, 4625, "bob", "10.0.0.1", "0xc000006a"},
+		{90, 4625, "bob", "10.0.0.1", "0xc000006a"},
+		{120, 4625, "bob", "10.0.0.1", "0xc000006a"},
+	})
+	if l := getAlerts("BruteForce"); len(l) != 0 {
+		t.Errorf("alert for failures out of window %v", l)
+	}
+	if n := len(authFailByAccount["bob"]); n != 2 {
+		t.Errorf("failures in window=%d", n)
+	}
+	// 時刻順でなくても時間枠の外の失敗を削除する
+	l := pruneAuthFail([]authFailEnt{{Time: 100}, {Time: 10}, {Time: 90}, {Time: 40}, {Time: 41}}, 100)
+	got := []int64{}
+	for _, e := range l {
+		got = append(got, e.Time)
+	}
+	if len(got) != 3 || got[0] != 100 || got[1] != 90 || got[2] != 41 {
+		t.Errorf("pruned=%v", got)
+	}
+}
+
+func TestGetAuthFailAccount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"bob", "bob"},
+		{"Bob", "bob"},
+		{"bob@CONTOSO.LOCAL", "bob"},
+		{`CONTOSO\Bob`, "bob"},
+		{`CONTOSO\bob@contoso.local`, "bob"},
+		{"PC01$", "pc01$"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := getAuthFailAccount(tt.in); got != tt.want {
+			t.Errorf("%s=%s want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// detect.bruteForce: 0,spray: 0,stBurst: 0で無効にできること
+func TestDetectConfigZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twwinlog.yaml")
+	if err := os.WriteFile(path, []byte("detect:\n  bruteForce: 0\n  spray: 0\n  stBurst: 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		bruteForceThreshold = 10
+		sprayThreshold = 10
+		stBurstThreshold = 10
+	}()
+	if err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if bruteForceThreshold != 0 || sprayThreshold != 0 || stBurstThreshold != 0 {
+		t.Errorf("bruteForce=%d spray=%d stBurst=%d", bruteForceThreshold, sprayThreshold, stBurstThreshold)
+	}
+}
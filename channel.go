@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// channelEnt : 監視するイベントログのチャンネル
+type channelEnt struct {
+	Name    string
+	Filter  string
+	Enabled bool
+}
+
+var channelList = []*channelEnt{}
+
+// parseChannels : "Security=*[System[(EventID=4624)]];!Application"の形式
+// ;で区切り、=の後はXPathのフィルター、先頭の!は無効
+// 名前の*と?は監視を始める時にwevtutil elのチャンネルに展開する
+func parseChannels(s string) ([]*channelEnt, error) {
+	ret := []*channelEnt{}
+	for _, c := range strings.Split(s, ";") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		e := &channelEnt{Enabled: true}
+		if strings.HasPrefix(c, "!") {
+			e.Enabled = false
+			c = c[1:]
+		}
+		if i := strings.Index(c, "="); i >= 0 {
+			e.Filter = strings.TrimSpace(c[i+1:])
+			c = c[:i]
+		}
+		e.Name = strings.TrimSpace(c)
+		if e.Name == "" {
+			return nil, fmt.Errorf("no channel name in '%s'", s)
+		}
+		if err := checkChannelFilter(e.Filter); err != nil {
+			return nil, fmt.Errorf("channel %s %v", e.Name, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// checkChannelFilter : 括弧の対応だけ確認する
+func checkChannelFilter(f string) error {
+	n := 0
+	for _, c := range f {
+		switch c {
+		case '[', '(':
+			n++
+		case ']', ')':
+			n--
+		}
+		if n < 0 {
+			return fmt.Errorf("bad filter '%s'", f)
+		}
+	}
+	if n != 0 {
+		return fmt.Errorf("bad filter '%s'", f)
+	}
+	return nil
+}
+
+// buildQuery : 読み込み位置の条件とチャンネルのフィルターを合わせたXPath
+func (c *channelEnt) buildQuery(cond string) string {
+	f := strings.TrimSpace(c.Filter)
+	if strings.HasPrefix(f, "*[") && strings.HasSuffix(f, "]") {
+		f = f[2 : len(f)-1]
+	}
+	if f == "" {
+		return fmt.Sprintf("*[System[%s]]", cond)
+	}
+	return fmt.Sprintf("*[System[%s] and (%s)]", cond, f)
+}
+
+// isChannelPattern : *か?を含むチャンネル名
+func isChannelPattern(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+// expandChannels : *と?を含むチャンネルをnamesのチャンネルに展開する
+// 名前を指定したチャンネルの設定を優先するので!で展開したチャンネルを無効にできる
+func expandChannels(list []*channelEnt, names []string) []*channelEnt {
+	ret := []*channelEnt{}
+	done := make(map[string]bool)
+	for _, c := range list {
+		if !isChannelPattern(c.Name) {
+			done[strings.ToLower(c.Name)] = true
+		}
+	}
+	for _, c := range list {
+		if !isChannelPattern(c.Name) {
+			ret = append(ret, c)
+			continue
+		}
+		re := regexp.MustCompile("(?i)^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(c.Name)) + "$")
+		for _, n := range names {
+			n = strings.TrimSpace(n)
+			if n == "" || done[strings.ToLower(n)] || !re.MatchString(n) {
+				continue
+			}
+			done[strings.ToLower(n)] = true
+			ret = append(ret, &channelEnt{Name: n, Filter: c.Filter, Enabled: c.Enabled})
+		}
+	}
+	return ret
+}
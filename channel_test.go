@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseChannels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []channelEnt
+		ok   bool
+	}{
+		{"System;Security;Application", []channelEnt{
+			{Name: "System", Enabled: true}, {Name: "Security", Enabled: true}, {Name: "Application", Enabled: true},
+		}, true},
+		{" System ; !Application ;", []channelEnt{
+			{Name: "System", Enabled: true}, {Name: "Application", Enabled: false},
+		}, true},
+		{"Microsoft-Windows-Sysmon/Operational=*[System[(EventID=1 or EventID=3)]]", []channelEnt{
+			{Name: "Microsoft-Windows-Sysmon/Operational", Filter: "*[System[(EventID=1 or EventID=3)]]", Enabled: true},
+		}, true},
+		{"!Security=*[EventData[Data[@Name='LogonType']='3']]", []channelEnt{
+			{Name: "Security", Filter: "*[EventData[Data[@Name='LogonType']='3']]", Enabled: false},
+		}, true},
+		{"Microsoft-Windows-TerminalServices-*", []channelEnt{
+			{Name: "Microsoft-Windows-TerminalServices-*", Enabled: true},
+		}, true},
+		{"=*[System]", nil, false},
+		{"!", nil, false},
+		{"Security=*[System[(EventID=4624)]", nil, false},
+		{"Security=*[System]]", nil, false},
+	}
+	for _, tt := range tests {
+		l, err := parseChannels(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s err=%v", tt.in, err)
+			continue
+		}
+		if len(l) != len(tt.want) {
+			t.Errorf("%s len=%d want %d", tt.in, len(l), len(tt.want))
+			continue
+		}
+		for i, c := range l {
+			if *c != tt.want[i] {
+				t.Errorf("%s %d=%+v want %+v", tt.in, i, *c, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	tests := []struct {
+		filter string
+		cond   string
+		want   string
+	}{
+		{"", "EventRecordID>100", "*[System[EventRecordID>100]]"},
+		{"*[System[(EventID=1 or EventID=3)]]", "EventRecordID>100",
+			"*[System[EventRecordID>100] and (System[(EventID=1 or EventID=3)])]"},
+		{"*[EventData[Data[@Name='LogonType']='3']]", "EventRecordID>0",
+			"*[System[EventRecordID>0] and (EventData[Data[@Name='LogonType']='3'])]"},
+		{"System[Level<=2]", "TimeCreated[@SystemTime>'2025-01-23T08:00:00']",
+			"*[System[TimeCreated[@SystemTime>'2025-01-23T08:00:00']] and (System[Level<=2])]"},
+	}
+	for _, tt := range tests {
+		c := &channelEnt{Name: "Security", Filter: tt.filter, Enabled: true}
+		if got := c.buildQuery(tt.cond); got != tt.want {
+			t.Errorf("%s=%s want %s", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestExpandChannels(t *testing.T) {
+	names := []string{
+		"Application",
+		"Microsoft-Windows-TerminalServices-LocalSessionManager/Operational",
+		"Microsoft-Windows-TerminalServices-Printers/Admin",
+		"Microsoft-Windows-TerminalServices-RemoteConnectionManager/Operational\r",
+		"Microsoft-Windows-Sysmon/Operational",
+		"Security",
+		"",
+	}
+	list, err := parseChannels("Security;microsoft-windows-terminalservices-*=*[System[Level<=3]];" +
+		"!Microsoft-Windows-TerminalServices-Printers/Admin;Microsoft-Windows-Sys?on/*;Setup*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []channelEnt{
+		{Name: "Security", Enabled: true},
+		{Name: "Microsoft-Windows-TerminalServices-LocalSessionManager/Operational", Filter: "*[System[Level<=3]]", Enabled: true},
+		{Name: "Microsoft-Windows-TerminalServices-RemoteConnectionManager/Operational", Filter: "*[System[Level<=3]]", Enabled: true},
+		{Name: "Microsoft-Windows-TerminalServices-Printers/Admin", Enabled: false},
+		{Name: "Microsoft-Windows-Sysmon/Operational", Enabled: true},
+	}
+	l := expandChannels(list, names)
+	if len(l) != len(want) {
+		t.Fatalf("len=%d want %d %v", len(l), len(want), l)
+	}
+	for i, c := range l {
+		if *c != want[i] {
+			t.Errorf("%d=%+v want %+v", i, *c, want[i])
+		}
+	}
+	// 展開する前は*と?を含むチャンネルを除く
+	if l := expandChannels(list, nil); len(l) != 2 {
+		t.Errorf("not expanded len=%d", len(l))
+	}
+}
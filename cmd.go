@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTの<topic>/cmdと<topic>/cmd/<clientID>で受信したコマンドを実行する
+
+// mqttCmdEnt : {"id":"1","cmd":"interval","interval":60}
+type mqttCmdEnt struct {
+	ID       string `json:"id"`
+	Cmd      string `json:"cmd"`
+	Interval int    `json:"interval"`
+	Handler  string `json:"handler"`
+	Enabled  *bool  `json:"enabled"`
+	Remote   string `json:"remote"`
+	Channel  string `json:"channel"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+}
+
+type mqttCmdResultDataEnt struct {
+	Time     string      `json:"time"`
+	ID       string      `json:"id"`
+	ClientID string      `json:"client_id"`
+	Cmd      string      `json:"cmd"`
+	Result   string      `json:"result"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+var mqttCmd = false
+
+// intervalMu : コマンドで変更する-intervalを保護する
+var intervalMu sync.Mutex
+
+// intervalChanged : 変更した時にcloseして作り直す
+var intervalChanged = make(chan struct{})
+
+func getInterval() int {
+	intervalMu.Lock()
+	defer intervalMu.Unlock()
+	return syslogInterval
+}
+
+// getIntervalChanged : 定期的な処理は受信したらタイマーを作り直す
+func getIntervalChanged() <-chan struct{} {
+	intervalMu.Lock()
+	defer intervalMu.Unlock()
+	return intervalChanged
+}
+
+func setInterval(n int) {
+	intervalMu.Lock()
+	defer intervalMu.Unlock()
+	syslogInterval = n
+	close(intervalChanged)
+	intervalChanged = make(chan struct{})
+}
+
+// subscribeMQTTCmd : 再接続した時も購読し直す
+func subscribeMQTTCmd(ctx context.Context, c mqtt.Client) {
+	if !mqttCmd {
+		return
+	}
+	for _, t := range []string{mqttTopic + "/cmd", mqttTopic + "/cmd/" + mqttClientID} {
+		token := c.Subscribe(t, 1, func(_ mqtt.Client, m mqtt.Message) {
+			// 受信の処理を止めないように別のgoroutineで実行する
+			go runMQTTCmd(ctx, m.Payload())
+		})
+		if token.WaitTimeout(time.Second*10) && token.Error() != nil {
+			log.Printf("mqtt subscribe topic=%s err=%v", t, token.Error())
+			continue
+		}
+		log.Printf("mqtt subscribe topic=%s", t)
+	}
+}
+
+func runMQTTCmd(ctx context.Context, payload []byte) {
+	var c mqttCmdEnt
+	if err := json.Unmarshal(payload, &c); err != nil {
+		sendMQTTCmdResult(&c, nil, fmt.Errorf("invalid command %v", err))
+		return
+	}
+	log.Printf("mqtt cmd id=%s cmd=%s", c.ID, c.Cmd)
+	var data interface{}
+	var err error
+	switch c.Cmd {
+	case "flush":
+		if !sendReport(getRemoteParam()) {
+			err = fmt.Errorf("send report busy")
+		}
+	case "interval":
+		if c.Interval < 10 {
+			err = fmt.Errorf("interval must be 10 or more")
+			break
+		}
+		setInterval(c.Interval)
+		data = map[string]int{"interval": c.Interval}
+	case "handler":
+		if c.Enabled == nil {
+			err = fmt.Errorf("enabled is required")
+			break
+		}
+		err = setHandlerEnabled(c.Handler, *c.Enabled)
+	case "status":
+		data = getStatus()
+	case "requery":
+		data, err = runRequeryCmd(ctx, &c)
+	default:
+		err = fmt.Errorf("unknown cmd %s", c.Cmd)
+	}
+	sendMQTTCmdResult(&c, data, err)
+}
+
+// runRequeryCmd : 時間の範囲のイベントを読み直す
+func runRequeryCmd(ctx context.Context, c *mqttCmdEnt) (interface{}, error) {
+	st, err := time.Parse(time.RFC3339, c.Start)
+	if err != nil {
+		return nil, fmt.Errorf("start: %v", err)
+	}
+	et := time.Now()
+	if c.End != "" {
+		if et, err = time.Parse(time.RFC3339, c.End); err != nil {
+			return nil, fmt.Errorf("end: %v", err)
+		}
+	}
+	if !st.Before(et) {
+		return nil, fmt.Errorf("start must be before end")
+	}
+	n, err := requeryWinlog(ctx, c.Remote, c.Channel, st, et)
+	return map[string]int{"count": n}, err
+}
+
+func sendMQTTCmdResult(c *mqttCmdEnt, data interface{}, err error) {
+	r := &mqttCmdResultDataEnt{
+		Time:     time.Now().Format(time.RFC3339),
+		ID:       c.ID,
+		ClientID: mqttClientID,
+		Cmd:      c.Cmd,
+		Result:   "ok",
+		Data:     data,
+	}
+	if err != nil {
+		r.Result = "error"
+		r.Error = err.Error()
+		log.Printf("mqtt cmd id=%s cmd=%s err=%v", c.ID, c.Cmd, err)
+	}
+	publishMQTT(r)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnt : YAMLの設定ファイル
+type configEnt struct {
+	Syslog struct {
+		Destinations []string `yaml:"destinations"`
+		CA           string   `yaml:"ca"`
+		Cert         string   `yaml:"cert"`
+		Key          string   `yaml:"key"`
+		Pin          string   `yaml:"pin"`
+		Format       string   `yaml:"format"`
+		Facility     string   `yaml:"facility"`
+		SDID         string   `yaml:"sdID"`
+	} `yaml:"syslog"`
+	MQTT struct {
+		Cmd      bool   `yaml:"cmd"`
+		Broker   string `yaml:"broker"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		ClientID string `yaml:"clientID"`
+		Topic    string `yaml:"topic"`
+		// TopicTemplate : {topic}/{sensor}/{computer}/{type}/{event_id}の形式
+		TopicTemplate string `yaml:"topicTemplate"`
+		CA            string `yaml:"ca"`
+		Cert          string `yaml:"cert"`
+		Key           string `yaml:"key"`
+		// QoS : defaultとメッセージの種類ごとのQoS
+		QoS    map[string]int `yaml:"qos"`
+		Retain []string       `yaml:"retain"`
+	} `yaml:"mqtt"`
+	Remote   remoteConfigEnt   `yaml:"remote"`
+	Remotes  []remoteConfigEnt `yaml:"remotes"`
+	Interval int               `yaml:"interval"`
+	State    string            `yaml:"state"`
+	Sigma    string            `yaml:"sigma"`
+	HTTP     string            `yaml:"http"`
+	Spool    struct {
+		Dir  string `yaml:"dir"`
+		Size int    `yaml:"size"`
+	} `yaml:"spool"`
+	Session struct {
+		TTL int `yaml:"ttl"`
+	} `yaml:"session"`
+	Process struct {
+		TTL int `yaml:"ttl"`
+		// Learn : 0は学習しないのでnilと区別する
+		Learn   *int     `yaml:"learn"`
+		LOLBins []string `yaml:"lolbins"`
+	} `yaml:"process"`
+	Detect struct {
+		Window int `yaml:"window"`
+		// 0は無効なのでnilと区別する
+		BruteForce *int `yaml:"bruteForce"`
+		Spray      *int `yaml:"spray"`
+		STBurst    *int `yaml:"stBurst"`
+	} `yaml:"detect"`
+	Debug            bool               `yaml:"debug"`
+	Channels         []channelConfigEnt `yaml:"channels"`
+	Handlers         map[string]bool    `yaml:"handlers"`
+	PrivilegedGroups []string           `yaml:"privilegedGroups"`
+	Skip             struct {
+		LogonTypes     []string `yaml:"logonTypes"`
+		PrivilegeUsers []string `yaml:"privilegeUsers"`
+	} `yaml:"skip"`
+	Filters []struct {
+		Name     string            `yaml:"name"`
+		Match    map[string]string `yaml:"match"`
+		Action   string            `yaml:"action"`
+		Severity int               `yaml:"severity"`
+		Stage    string            `yaml:"stage"`
+	} `yaml:"filters"`
+}
+
+type remoteConfigEnt struct {
+	Host     string             `yaml:"host"`
+	User     string             `yaml:"user"`
+	Password string             `yaml:"password"`
+	Auth     string             `yaml:"auth"`
+	Channels []channelConfigEnt `yaml:"channels"`
+}
+
+type channelConfigEnt struct {
+	Name    string `yaml:"name"`
+	Filter  string `yaml:"filter"`
+	Enabled *bool  `yaml:"enabled"`
+}
+
+var configFile = ""
+
+// configReload : 再読み込みの時はconfigReloadFlags以外のパラメータを変更しない
+// 再読み込みで変更するパラメータはfilterRules以外はeventMuをロックして読む
+var configReload = false
+
+// reloadMu : 同時に再読み込みしないようにする
+var reloadMu sync.Mutex
+
+// configReloadFlags : 再起動しなくても変更できるパラメータ
+var configReloadFlags = map[string]bool{
+	"sessionTTL": true, "processTTL": true, "learnPeriod": true, "sigma": true,
+	"detectWindow": true, "bruteForce": true, "spray": true, "stBurst": true,
+}
+
+// flagSet : コマンドラインか環境変数で指定したパラメータ
+var flagSet = make(map[string]bool)
+
+// handlerNames : 有効/無効を設定できるハンドラー
+var handlerNames = []string{"logon", "session", "bruteForce", "roasting", "process", "processInstance", "processTree", "clearLog", "task", "service", "kerberos", "privilege", "account", "group"}
+
+var handlerEnabled = make(map[string]bool)
+
+// logonSkipTypes : 送信しないログオンタイプ
+var logonSkipTypes = []string{"Service"}
+
+// privilegeSkipUsers : 集計しない特権アクセスのユーザー
+var privilegeSkipUsers = []string{"LOCAL SERVICE", "SYSTEM"}
+
+// privilegedGroupList : 変更をアラートにするグループ
+var privilegedGroupList = []string{
+	"Domain Admins", "Enterprise Admins", "Schema Admins", "Administrators",
+	"Account Operators", "Backup Operators", "Server Operators", "DnsAdmins",
+	"-512", "-518", "-519", "S-1-5-32-544",
+}
+
+// configChannels : 設定ファイルのチャンネル
+var configChannels []*channelEnt
+
+// setHandlerEnabled : 実行中にハンドラーを有効/無効にする
+func setHandlerEnabled(name string, enabled bool) error {
+	found := false
+	for _, n := range handlerNames {
+		if n == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown handler %s (%s)", name, strings.Join(handlerNames, ","))
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	m := make(map[string]bool)
+	for k, v := range handlerEnabled {
+		m[k] = v
+	}
+	m[name] = enabled
+	handlerEnabled = m
+	return nil
+}
+
+func isHandlerEnabled(name string) bool {
+	if v, ok := handlerEnabled[name]; ok {
+		return v
+	}
+	return true
+}
+
+// loadConfig : 設定ファイルを読み込む。コマンドラインで指定したパラメータは上書きしない
+func loadConfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return err
+	}
+	if len(root.Content) < 1 {
+		return nil
+	}
+	if errs := checkConfigNode(root.Content[0], reflect.TypeOf(configEnt{}), ""); len(errs) > 0 {
+		return fmt.Errorf("%s\n%s", path, strings.Join(errs, "\n"))
+	}
+	cfg := new(configEnt)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s %v", path, err)
+	}
+	return applyConfig(cfg)
+}
+
+func applyConfig(cfg *configEnt) error {
+	setFlag := func(name, v string) {
+		if v != "" && !flagSet[name] && (!configReload || configReloadFlags[name]) {
+			flag.Set(name, v)
+		}
+	}
+	setFlag("syslog", strings.Join(cfg.Syslog.Destinations, ","))
+	setFlag("syslogCA", cfg.Syslog.CA)
+	setFlag("syslogCert", cfg.Syslog.Cert)
+	setFlag("syslogKey", cfg.Syslog.Key)
+	setFlag("syslogPin", cfg.Syslog.Pin)
+	setFlag("syslogFormat", cfg.Syslog.Format)
+	setFlag("syslogFacility", cfg.Syslog.Facility)
+	setFlag("syslogSDID", cfg.Syslog.SDID)
+	setFlag("mqtt", cfg.MQTT.Broker)
+	setFlag("mqttUser", cfg.MQTT.User)
+	setFlag("mqttPassword", cfg.MQTT.Password)
+	setFlag("mqttClientID", cfg.MQTT.ClientID)
+	setFlag("mqttTopic", cfg.MQTT.Topic)
+	setFlag("mqttTopicTemplate", cfg.MQTT.TopicTemplate)
+	if cfg.MQTT.Cmd {
+		setFlag("mqttCmd", "true")
+	}
+	setFlag("mqttCA", cfg.MQTT.CA)
+	setFlag("mqttCert", cfg.MQTT.Cert)
+	setFlag("mqttKey", cfg.MQTT.Key)
+	if len(cfg.MQTT.QoS) > 0 {
+		qos := []string{}
+		for k, v := range cfg.MQTT.QoS {
+			if k == "default" {
+				qos = append([]string{fmt.Sprintf("%d", v)}, qos...)
+			} else {
+				qos = append(qos, fmt.Sprintf("%s=%d", k, v))
+			}
+		}
+		setFlag("mqttQoS", strings.Join(qos, ","))
+	}
+	setFlag("mqttRetain", strings.Join(cfg.MQTT.Retain, ","))
+	setFlag("user", cfg.Remote.User)
+	setFlag("password", cfg.Remote.Password)
+	setFlag("auth", cfg.Remote.Auth)
+	if cfg.Interval > 0 {
+		setFlag("interval", fmt.Sprintf("%d", cfg.Interval))
+	}
+	if cfg.Session.TTL > 0 {
+		setFlag("sessionTTL", fmt.Sprintf("%d", cfg.Session.TTL))
+	}
+	if cfg.Process.TTL > 0 {
+		setFlag("processTTL", fmt.Sprintf("%d", cfg.Process.TTL))
+	}
+	if cfg.HTTP != "" {
+		setFlag("http", cfg.HTTP)
+	}
+	if cfg.Sigma != "" {
+		setFlag("sigma", cfg.Sigma)
+	}
+	if cfg.Process.Learn != nil {
+		if *cfg.Process.Learn < 0 {
+			return fmt.Errorf("process.learn: must be 0 or more")
+		}
+		setFlag("learnPeriod", fmt.Sprintf("%d", *cfg.Process.Learn))
+	}
+	if cfg.Process.LOLBins != nil {
+		lolbinList = cfg.Process.LOLBins
+	}
+	if cfg.Detect.Window > 0 {
+		setFlag("detectWindow", fmt.Sprintf("%d", cfg.Detect.Window))
+	}
+	if cfg.Detect.BruteForce != nil {
+		setFlag("bruteForce", fmt.Sprintf("%d", *cfg.Detect.BruteForce))
+	}
+	if cfg.Detect.Spray != nil {
+		setFlag("spray", fmt.Sprintf("%d", *cfg.Detect.Spray))
+	}
+	if cfg.Detect.STBurst != nil {
+		setFlag("stBurst", fmt.Sprintf("%d", *cfg.Detect.STBurst))
+	}
+	setFlag("state", cfg.State)
+	setFlag("spool", cfg.Spool.Dir)
+	if cfg.Spool.Size > 0 {
+		setFlag("spoolSize", fmt.Sprintf("%d", cfg.Spool.Size))
+	}
+	if cfg.Debug {
+		setFlag("debug", "true")
+	}
+	if len(cfg.Channels) > 0 && !configReload {
+		l, err := makeConfigChannels(cfg.Channels, "channels")
+		if err != nil {
+			return err
+		}
+		configChannels = l
+	}
+	remotes := cfg.Remotes
+	if cfg.Remote.Host != "" {
+		remotes = append([]remoteConfigEnt{cfg.Remote}, remotes...)
+	}
+	if len(remotes) > 0 && !configReload {
+		configRemotes = []*remoteEnt{}
+		for i, r := range remotes {
+			if r.Host == "" {
+				return fmt.Errorf("remotes[%d].host: host is required", i)
+			}
+			l, err := makeConfigChannels(r.Channels, fmt.Sprintf("remotes[%d].channels", i))
+			if err != nil {
+				return err
+			}
+			e := &remoteEnt{
+				Host:     r.Host,
+				User:     r.User,
+				Password: r.Password,
+				Auth:     r.Auth,
+				Channels: l,
+			}
+			// 指定がなければ共通の認証情報を使う
+			if e.User == "" {
+				e.User, e.Password = user, password
+			}
+			if e.Auth == "" {
+				e.Auth = auth
+			}
+			configRemotes = append(configRemotes, e)
+		}
+	}
+	handlers := make(map[string]bool)
+	for k, v := range cfg.Handlers {
+		found := false
+		for _, n := range handlerNames {
+			if n == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("handlers.%s: unknown handler (%s)", k, strings.Join(handlerNames, ","))
+		}
+		handlers[k] = v
+	}
+	handlerEnabled = handlers
+	if cfg.Skip.LogonTypes != nil {
+		logonSkipTypes = cfg.Skip.LogonTypes
+	}
+	if cfg.Skip.PrivilegeUsers != nil {
+		privilegeSkipUsers = cfg.Skip.PrivilegeUsers
+	}
+	if cfg.PrivilegedGroups != nil {
+		privilegedGroupList = cfg.PrivilegedGroups
+	}
+	rules := []*filterRuleEnt{}
+	for i, f := range cfg.Filters {
+		if f.Name == "" {
+			f.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		r, err := newFilterRule(f.Name, f.Match, f.Action, f.Severity, f.Stage)
+		if err != nil {
+			return fmt.Errorf("filters[%d].%v", i, err)
+		}
+		rules = append(rules, r)
+	}
+	filterRules.Store(&rules)
+	return nil
+}
+
+// reloadConfig : 設定ファイルとSigmaルールを再読み込みする
+// 送信先、リモート、チャネルなどは再起動するまで変更しない
+func reloadConfig() error {
+	if configFile == "" {
+		return fmt.Errorf("no config file")
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	eventMu.Lock()
+	configReload = true
+	err := loadConfig(configFile)
+	configReload = false
+	eventMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return loadSigmaRules()
+}
+
+func makeConfigChannels(list []channelConfigEnt, path string) ([]*channelEnt, error) {
+	ret := []*channelEnt{}
+	for i, c := range list {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s[%d].name: channel name is required", path, i)
+		}
+		if err := checkChannelFilter(c.Filter); err != nil {
+			return nil, fmt.Errorf("%s[%d].filter: %v", path, i, err)
+		}
+		ret = append(ret, &channelEnt{
+			Name:    c.Name,
+			Filter:  c.Filter,
+			Enabled: c.Enabled == nil || *c.Enabled,
+		})
+	}
+	return ret, nil
+}
+
+// checkConfigNode : 設定ファイルの間違いをキーの位置と一緒に返す
+func checkConfigNode(n *yaml.Node, t reflect.Type, path string) []string {
+	errs := []string{}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return errs
+	}
+	bad := func(msg string) []string {
+		return append(errs, fmt.Sprintf("line %d: %s: %s", n.Line, strings.TrimPrefix(path, "."), msg))
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return bad("must be a mapping")
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			f, ok := findConfigField(t, k.Value)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("line %d: %s: unknown key", k.Line, strings.TrimPrefix(path+"."+k.Value, ".")))
+				continue
+			}
+			errs = append(errs, checkConfigNode(n.Content[i+1], f.Type, path+"."+k.Value)...)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return bad("must be a mapping")
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			errs = append(errs, checkConfigNode(n.Content[i+1], t.Elem(), path+"."+n.Content[i].Value)...)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return bad("must be a list")
+		}
+		for i, c := range n.Content {
+			errs = append(errs, checkConfigNode(c, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.String:
+		if n.Kind != yaml.ScalarNode {
+			return bad("must be a string")
+		}
+	case reflect.Int:
+		if _, err := strconv.Atoi(n.Value); n.Kind != yaml.ScalarNode || err != nil {
+			return bad("must be an integer")
+		}
+	case reflect.Float64:
+		if _, err := strconv.ParseFloat(n.Value, 64); n.Kind != yaml.ScalarNode || err != nil {
+			return bad("must be a number")
+		}
+	case reflect.Bool:
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!bool" {
+			return bad("must be true or false")
+		}
+	}
+	return errs
+}
+
+func findConfigField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.Split(f.Tag.Get("yaml"), ",")[0] == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
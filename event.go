@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reportBusy : タイマー、APIとMQTTのコマンドからの同時のレポート送信を防ぐ
+var reportBusy atomic.Bool
+
+// eventMu : 複数のPCのイベントを同時に集計しないようにする
+var eventMu sync.Mutex
+var logonCount atomic.Int64
+var logoffCount atomic.Int64
+var logonFailedCount atomic.Int64
+var processCount atomic.Int64
+var kerberosCount atomic.Int64
+var taskCount atomic.Int64
+var accountCount atomic.Int64
+var privilegeCount atomic.Int64
+
+// <Data Name='SubjectUserName'>DESKTOP-T6L1D1U$</Data>
+// <Data Name='SubjectDomainName'>WORKGROUP</Data>
+// <Data Name='TargetUserName'>SYSTEM</Data>
+// <Data Name='TargetDomainName'>NT AUTHORITY</Data>
+// <Data Name='IpAddress'>-</Data>
+// <Data Name='SubStatus'>0xc0000064</Data>
+// <Data Name='TargetServerName'>WIN-ABEORAE1LF6.ymitest.local</Data>
+// <Data Name="TaskName">\\Microsoft\\StartListener</Data>
+
+var eventIDMap sync.Map
+
+// lastEventTime : 最後に処理したイベントの時刻
+var lastEventTime int64
+
+// getCheckTime : 期限切れを判断する時刻。リプレイの時はイベントの時刻を使う
+func getCheckTime() int64 {
+	if isReplay() {
+		return lastEventTime
+	}
+	return time.Now().Unix()
+}
+
+// syslogでレポートを送信する。送信中で何もしなかった時はfalseを返す
+func sendReport(param string) bool {
+	if !reportBusy.CompareAndSwap(false, true) {
+		log.Printf("send report busy")
+		return false
+	}
+	defer reportBusy.Store(false)
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	sendEventID()
+	expireSessions()
+	expireProcessInstances()
+	cleanupAuthFail()
+	cleanupRoasting()
+	sendAccount()
+	sendKerberos()
+	sendPrivilege()
+	sendTask()
+	sendService()
+	sendGroup()
+	sendProcess()
+	sendMonitor(param)
+	return true
+}
+
+// sendStats : 処理したイベント数を送信する
+func sendStats(total, count int, param string) {
+	spooled, queued, dropped := getSpoolStats()
+	sendSyslog(&syslogEnt{
+		Time:     time.Now(),
+		Severity: 6,
+		Fields: newSyslogFields("type", "Stats", "total", total, "count", count,
+			"ps", fmt.Sprintf("%.2f", float64(count)/float64(getInterval())), "send", getSyslogSent(), "param", param,
+			"spooled", spooled, "queued", queued, "dropped", dropped),
+	})
+	publishMQTT(&mqttStatsDataEnt{
+		Time:    time.Now().Format(time.RFC3339),
+		Total:   total,
+		Count:   count,
+		PS:      float64(count) / float64(getInterval()),
+		Params:  param,
+		Spooled: spooled,
+		Queued:  queued,
+		Dropped: dropped,
+	})
+	if s := getFilterStats(); s != "" {
+		log.Printf("filter dropped %s", s)
+	}
+}
+
+// System represents the Windows Event Log XML format.
+type System struct {
+	Provider struct {
+		Name string `xml:"Name,attr"`
+	}
+	EventID       int    `xml:"EventID"`
+	Level         int    `xml:"Level"`
+	EventRecordID int64  `xml:"EventRecordID"`
+	Channel       string `xml:"Channel"`
+	Computer      string `xml:"Computer"`
+	Security      struct {
+		UserID string `xml:"UserID,attr"`
+	}
+	TimeCreated struct {
+		SystemTime string `xml:"SystemTime,attr"`
+	}
+}
+
+var reEventStart = regexp.MustCompile(`<Event[\s>]`)
+
+// checkEvents : wevtutil形式のXMLからイベントを取り出して処理する
+// 処理したイベントの数と最後のEventRecordIDを返す
+func checkEvents(out string) (int, int64) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	ret := 0
+	var lastID int64
+	for _, l := range strings.Split(out, "</Event>") {
+		loc := reEventStart.FindStringIndex(l)
+		if loc == nil {
+			continue
+		}
+		ev := new(Event)
+		if err := xml.Unmarshal([]byte(l[loc[0]:]+"</Event>"), ev); err != nil {
+			log.Printf("xml err=%v", err)
+			continue
+		}
+		t := getEventTime(ev.System.TimeCreated.SystemTime)
+		if t.Unix() > lastEventTime {
+			lastEventTime = t.Unix()
+		}
+		updateEventIDMap(&ev.System, t)
+		ret++
+		if ev.System.EventRecordID > lastID {
+			lastID = ev.System.EventRecordID
+		}
+		if !filterEvent(ev) {
+			continue
+		}
+		if len(sigmaRules) > 0 {
+			checkSigma(ev, t)
+		}
+		switch ev.System.Channel {
+		case "Security":
+		case "System":
+			if ev.System.EventID == 7045 && isHandlerEnabled("service") {
+				updateService(ev, t)
+			}
+			continue
+		default:
+			continue
+		}
+		if isHandlerEnabled("bruteForce") {
+			checkAuthEvent(ev, t)
+		}
+		switch ev.System.EventID {
+		case 4624, 4625, 4648, 4634, 4647:
+			if isHandlerEnabled("logon") {
+				checkLogon(ev, t)
+			}
+			if isHandlerEnabled("session") {
+				checkSession(ev, t)
+			}
+		case 4688, 4689:
+			if isHandlerEnabled("process") {
+				updateProcess(ev, t)
+			}
+			if isHandlerEnabled("processInstance") {
+				updateProcessInstance(ev, t)
+			}
+			if ev.System.EventID == 4688 && isHandlerEnabled("processTree") {
+				checkProcessBaseline(ev, t)
+			}
+		case 1102:
+			if isHandlerEnabled("clearLog") {
+				sendClearLog(ev, t)
+			}
+		case 4698, 4699, 4700, 4701, 4702:
+			if isHandlerEnabled("task") {
+				log.Printf("task in %v,%v", ev.System, ev.EventData.Keys)
+				updateTask(ev, t)
+			}
+		case 4768, 4769:
+			if isHandlerEnabled("roasting") {
+				checkRoastingEvent(ev, t)
+			}
+			if isHandlerEnabled("kerberos") {
+				updateKerberos(ev, t)
+			}
+		case 4672, 4673:
+			if isHandlerEnabled("privilege") {
+				updatePrivilege(ev, t)
+			}
+		case 4728, 4729, 4732, 4733, 4756, 4757:
+			if isHandlerEnabled("group") {
+				updateGroup(ev, t)
+			}
+		case 4697:
+			if isHandlerEnabled("service") {
+				updateService(ev, t)
+			}
+		case 4720, 4722, 4723, 4724, 4725, 4726, 4738, 4740, 4767, 4781:
+			if isHandlerEnabled("account") {
+				updateAccount(ev, t)
+			}
+		}
+	}
+	return ret, lastID
+}
+
+// Event represents a Windows event log record decoded from XML.
+type Event struct {
+	System    System    `xml:"System"`
+	EventData EventData `xml:"EventData"`
+	UserData  EventData `xml:"UserData"`
+}
+
+// Get returns the value of EventData or UserData field. "-" is returned as empty.
+func (ev *Event) Get(name string) string {
+	v, ok := ev.EventData.Values[name]
+	if !ok {
+		v = ev.UserData.Values[name]
+	}
+	if v == "-" {
+		return ""
+	}
+	return v
+}
+
+// EventData is the ordered name/value list of <EventData> or <UserData>.
+type EventData struct {
+	Keys   []string
+	Values map[string]string
+}
+
+// UnmarshalXML : <Data Name='x'>はNameの値、<UserData>の中はタグ名をキーにする
+func (d *EventData) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	d.Values = make(map[string]string)
+	name := ""
+	text := ""
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			name = tok.Name.Local
+			for _, a := range tok.Attr {
+				if a.Name.Local == "Name" {
+					name = a.Value
+				}
+			}
+			text = ""
+		case xml.CharData:
+			text += string(tok)
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+			if name != "" {
+				d.add(name, text)
+			}
+			name = ""
+			text = ""
+		}
+	}
+}
+
+func (d *EventData) add(name, value string) {
+	k := name
+	for i := 2; ; i++ {
+		if _, ok := d.Values[k]; !ok {
+			break
+		}
+		k = fmt.Sprintf("%s%d", name, i)
+	}
+	d.Keys = append(d.Keys, k)
+	d.Values[k] = value
+}
+
+func getEventTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		log.Printf(" err=%v", err)
+		return time.Now()
+	}
+	return t.Local()
+}
+
+type EventIDEnt struct {
+	Computer  string
+	Provider  string
+	Channel   string
+	EventID   int
+	Level     int
+	Total     int
+	Count     int
+	FirstTime int64
+	LastTime  int64
+}
+
+func (e *EventIDEnt) Fields() syslogFields {
+	return newSyslogFields("type", "EventID", "computer", e.Computer, "channel", e.Channel, "provider", e.Provider,
+		"eventID", e.EventID, "total", e.Total, "count", e.Count,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339))
+}
+
+func updateEventIDMap(s *System, t time.Time) {
+	ts := t.Unix()
+	id := fmt.Sprintf("%s:%s:%d", s.Computer, s.Provider, s.EventID)
+	if v, ok := eventIDMap.Load(id); ok {
+		if e, ok := v.(*EventIDEnt); ok {
+			e.Count++
+			e.Total++
+			if e.LastTime < ts {
+				e.LastTime = ts
+			}
+			if s.Level != 0 && e.Level != 0 && e.Level > s.Level {
+				e.Level = s.Level
+			}
+		}
+		return
+	}
+	eventIDMap.Store(id, &EventIDEnt{
+		EventID:   s.EventID,
+		Level:     s.Level,
+		Computer:  s.Computer,
+		Channel:   s.Channel,
+		Provider:  s.Provider.Name,
+		Total:     1,
+		Count:     1,
+		FirstTime: ts,
+		LastTime:  ts,
+	})
+}
+
+func sendEventID() {
+	eventIDMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*EventIDEnt); ok {
+			if e.Count < 1 {
+				return true
+			}
+			sv := 6
+			level := "INFO"
+			switch e.Level {
+			case 1:
+				sv = 2
+				level = "CRIT"
+			case 2:
+				sv = 3
+				level = "ERROR"
+			case 3:
+				sv = 4
+				level = "WARN"
+			}
+			sendSyslog(&syslogEnt{
+				Severity: sv,
+				Time:     time.Now(),
+				Fields:   e.Fields(),
+			})
+			publishMQTT(&mqttEventIDDataEnt{
+				Time:      time.Now().Format(time.RFC3339),
+				Computer:  e.Computer,
+				Provider:  e.Provider,
+				Channel:   e.Channel,
+				EventID:   e.EventID,
+				Level:     level,
+				Total:     e.Total,
+				Count:     e.Count,
+				FirstTime: time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+				LastTime:  time.Unix(e.LastTime, 0).Format(time.RFC3339),
+			})
+			e.Count = 0
+		}
+		return true
+	})
+}
+
+func sendClearLog(ev *Event, t time.Time) {
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
+	subjectUserSid := ev.Get("SubjectUserSid")
+	f := newSyslogFields("type", "ClearLog", "subject", subjectUserName+"@"+subjectDomainName, "sid", subjectUserSid)
+	msg := f.String()
+	sendSyslog(&syslogEnt{
+		Severity: 2,
+		Time:     t,
+		Msg:      msg,
+		Fields:   f,
+	})
+	publishMQTT(&mqttMessageDataEnt{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   "CRIT",
+		Type:    "ClearLog",
+		Message: msg,
+	})
+}
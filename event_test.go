@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestEventDataUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		xml  string
+		keys []string
+		want map[string]string
+	}{
+		{
+			"single quote",
+			`<EventData><Data Name='TargetUserName'>bob</Data><Data Name='IpAddress'>10.0.0.1</Data></EventData>`,
+			[]string{"TargetUserName", "IpAddress"},
+			map[string]string{"TargetUserName": "bob", "IpAddress": "10.0.0.1"},
+		},
+		{
+			"double quote",
+			`<EventData><Data Name="TargetUserName">bob</Data><Data Name="LogonType">3</Data></EventData>`,
+			[]string{"TargetUserName", "LogonType"},
+			map[string]string{"TargetUserName": "bob", "LogonType": "3"},
+		},
+		{
+			"entity",
+			`<EventData><Data Name='CommandLine'>cmd /c "a &amp; b" &lt;in.txt &gt;out.txt &apos;x&apos; &quot;y&quot;</Data></EventData>`,
+			[]string{"CommandLine"},
+			map[string]string{"CommandLine": `cmd /c "a & b" <in.txt >out.txt 'x' "y"`},
+		},
+		{
+			"cdata and newline",
+			"<EventData><Data Name='ScriptBlockText'><![CDATA[if (a < b) {\r\n  x\r\n}]]></Data></EventData>",
+			[]string{"ScriptBlockText"},
+			// XMLの改行はLFになる
+			map[string]string{"ScriptBlockText": "if (a < b) {\n  x\n}"},
+		},
+		{
+			"empty",
+			`<EventData><Data Name='SubjectUserName'/><Data Name='Status'></Data><Data Name='IpAddress'>-</Data></EventData>`,
+			[]string{"SubjectUserName", "Status", "IpAddress"},
+			map[string]string{"SubjectUserName": "", "Status": "", "IpAddress": "-"},
+		},
+		{
+			"no name and duplicate",
+			`<EventData><Data>first</Data><Data>second</Data><Data Name='Param'>a</Data><Data Name='Param'>b</Data><Data Name='Param'>c</Data></EventData>`,
+			[]string{"Data", "Data2", "Param", "Param2", "Param3"},
+			map[string]string{"Data": "first", "Data2": "second", "Param": "a", "Param2": "b", "Param3": "c"},
+		},
+		{
+			"formatted",
+			"<EventData>\n  <Data Name='TaskName'>\\Updater</Data>\n  <Data Name='TaskContent'>&lt;?xml version=\"1.0\"?&gt;&lt;Task&gt;&lt;/Task&gt;</Data>\n</EventData>",
+			[]string{"TaskName", "TaskContent"},
+			map[string]string{"TaskName": `\Updater`, "TaskContent": `<?xml version="1.0"?><Task></Task>`},
+		},
+	}
+	for _, tt := range tests {
+		var d EventData
+		if err := xml.Unmarshal([]byte(tt.xml), &d); err != nil {
+			t.Errorf("%s err=%v", tt.name, err)
+			continue
+		}
+		if len(d.Keys) != len(tt.keys) {
+			t.Errorf("%s keys=%v want %v", tt.name, d.Keys, tt.keys)
+			continue
+		}
+		for i, k := range tt.keys {
+			if d.Keys[i] != k {
+				t.Errorf("%s keys=%v want %v", tt.name, d.Keys, tt.keys)
+				break
+			}
+		}
+		for k, v := range tt.want {
+			if got, ok := d.Values[k]; !ok || got != v {
+				t.Errorf("%s %s=%q want %q", tt.name, k, got, v)
+			}
+		}
+	}
+}
+
+// <UserData>の中はタグ名をキーにする
+func TestEventUserData(t *testing.T) {
+	x := `<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'><System>
+<Provider Name='Microsoft-Windows-Eventlog'/><EventID>1102</EventID><Channel>Security</Channel><Computer>DC01</Computer>
+</System><UserData><LogFileCleared xmlns="http://manifests.microsoft.com/win/2004/08/windows/eventlog">
+<SubjectUserSid>S-1-5-21-1-2-3-500</SubjectUserSid>
+<SubjectUserName>Administrator</SubjectUserName>
+<SubjectDomainName>CONTOSO</SubjectDomainName>
+<SubjectLogonId>-</SubjectLogonId>
+</LogFileCleared></UserData></Event>`
+	ev := new(Event)
+	if err := xml.Unmarshal([]byte(x), ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.System.EventID != 1102 || ev.System.Provider.Name != "Microsoft-Windows-Eventlog" {
+		t.Errorf("system=%+v", ev.System)
+	}
+	want := []string{"SubjectUserSid", "SubjectUserName", "SubjectDomainName", "SubjectLogonId"}
+	if len(ev.UserData.Keys) != len(want) {
+		t.Fatalf("keys=%v want %v", ev.UserData.Keys, want)
+	}
+	for i, k := range want {
+		if ev.UserData.Keys[i] != k {
+			t.Errorf("keys=%v want %v", ev.UserData.Keys, want)
+			break
+		}
+	}
+	tests := map[string]string{
+		"SubjectUserName":   "Administrator",
+		"SubjectDomainName": "CONTOSO",
+		"SubjectLogonId":    "",
+		"LogFileCleared":    "",
+	}
+	for k, v := range tests {
+		if got := ev.Get(k); got != v {
+			t.Errorf("%s=%q want %q", k, got, v)
+		}
+	}
+	if len(ev.EventData.Keys) != 0 {
+		t.Errorf("eventData=%v", ev.EventData.Keys)
+	}
+}
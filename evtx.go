@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// EVTXファイルをwevtutil qe /f:xmlと同じXMLに変換する
+
+const evtxFileHeaderSize = 4096
+const evtxChunkSize = 65536
+const evtxChunkHeaderSize = 512
+
+var evtxFileMagic = []byte("ElfFile\x00")
+var evtxChunkMagic = []byte("ElfChnk\x00")
+var evtxRecordMagic = []byte{0x2a, 0x2a, 0x00, 0x00}
+
+// BinXMLのトークン
+const (
+	binXMLEOF                  = 0x00
+	binXMLOpenStartElement     = 0x01
+	binXMLCloseStartElement    = 0x02
+	binXMLCloseEmptyElement    = 0x03
+	binXMLEndElement           = 0x04
+	binXMLValue                = 0x05
+	binXMLAttribute            = 0x06
+	binXMLCDATA                = 0x07
+	binXMLCharRef              = 0x08
+	binXMLEntityRef            = 0x09
+	binXMLPITarget             = 0x0a
+	binXMLPIData               = 0x0b
+	binXMLTemplateInstance     = 0x0c
+	binXMLNormalSubstitution   = 0x0d
+	binXMLOptionalSubstitution = 0x0e
+	binXMLFragmentHeader       = 0x0f
+	binXMLMoreBit              = 0x40
+)
+
+// BinXMLの値の型
+const (
+	evtxTypeNull       = 0x00
+	evtxTypeString     = 0x01
+	evtxTypeAnsiString = 0x02
+	evtxTypeInt8       = 0x03
+	evtxTypeUInt8      = 0x04
+	evtxTypeInt16      = 0x05
+	evtxTypeUInt16     = 0x06
+	evtxTypeInt32      = 0x07
+	evtxTypeUInt32     = 0x08
+	evtxTypeInt64      = 0x09
+	evtxTypeUInt64     = 0x0a
+	evtxTypeReal32     = 0x0b
+	evtxTypeReal64     = 0x0c
+	evtxTypeBool       = 0x0d
+	evtxTypeBinary     = 0x0e
+	evtxTypeGUID       = 0x0f
+	evtxTypeSizeT      = 0x10
+	evtxTypeFileTime   = 0x11
+	evtxTypeSysTime    = 0x12
+	evtxTypeSID        = 0x13
+	evtxTypeHexInt32   = 0x14
+	evtxTypeHexInt64   = 0x15
+	evtxTypeBinXML     = 0x21
+	evtxTypeArray      = 0x80
+)
+
+var errEvtxShort = errors.New("evtx data too short")
+
+// evtxChunk : 64KBのチャンク
+type evtxChunk struct {
+	data          []byte
+	firstRecordID uint64
+}
+
+// evtxValue : テンプレートに埋め込む値
+type evtxValue struct {
+	vtype byte
+	off   int
+	data  []byte
+}
+
+// readEvtx : EVTXファイルの全レコードをXMLにしてcbを呼び出す
+func readEvtx(path string, cb func(string)) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < evtxFileHeaderSize || !bytes.HasPrefix(b, evtxFileMagic) {
+		return 0, fmt.Errorf("not evtx file %s", path)
+	}
+	chunks := []*evtxChunk{}
+	for off := evtxFileHeaderSize; off+evtxChunkSize <= len(b); off += evtxChunkSize {
+		d := b[off : off+evtxChunkSize]
+		if !bytes.HasPrefix(d, evtxChunkMagic) {
+			continue
+		}
+		chunks = append(chunks, &evtxChunk{
+			data:          d,
+			firstRecordID: binary.LittleEndian.Uint64(d[24:]),
+		})
+	}
+	// チャンクはリングバッファなのでレコードIDの順に並べる
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].firstRecordID < chunks[j].firstRecordID
+	})
+	ret := 0
+	for _, c := range chunks {
+		ret += c.readRecords(cb)
+	}
+	return ret, nil
+}
+
+func (c *evtxChunk) readRecords(cb func(string)) int {
+	ret := 0
+	free := int(binary.LittleEndian.Uint32(c.data[48:]))
+	if free > len(c.data) || free < evtxChunkHeaderSize {
+		free = len(c.data)
+	}
+	for off := evtxChunkHeaderSize; off+24 <= free; {
+		if !bytes.Equal(c.data[off:off+4], evtxRecordMagic) {
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(c.data[off+4:]))
+		if size < 28 || off+size > len(c.data) {
+			break
+		}
+		if x, err := c.renderRecord(off+24, off+size-4); err == nil {
+			cb(x)
+			ret++
+		} else if debug {
+			log.Printf("evtx record err=%v id=%d", err, binary.LittleEndian.Uint64(c.data[off+8:]))
+		}
+		off += size
+	}
+	return ret
+}
+
+func (c *evtxChunk) renderRecord(start, end int) (x string, err error) {
+	defer func() {
+		// 壊れたレコードで停止しないようにする
+		if r := recover(); r != nil {
+			err = fmt.Errorf("evtx parse panic %v", r)
+		}
+	}()
+	sb := &strings.Builder{}
+	p := &evtxParser{chunk: c, pos: start, end: end}
+	if err := p.render(sb, nil); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// evtxParser : BinXMLをチャンク内の位置から読み込む
+type evtxParser struct {
+	chunk *evtxChunk
+	pos   int
+	end   int
+}
+
+func (p *evtxParser) need(n int) error {
+	if p.pos+n > p.end || p.pos+n > len(p.chunk.data) {
+		return errEvtxShort
+	}
+	return nil
+}
+
+func (p *evtxParser) u8() (byte, error) {
+	if err := p.need(1); err != nil {
+		return 0, err
+	}
+	v := p.chunk.data[p.pos]
+	p.pos++
+	return v, nil
+}
+
+func (p *evtxParser) u16() (uint16, error) {
+	if err := p.need(2); err != nil {
+		return 0, err
+	}
+	v := binary.LittleEndian.Uint16(p.chunk.data[p.pos:])
+	p.pos += 2
+	return v, nil
+}
+
+func (p *evtxParser) u32() (uint32, error) {
+	if err := p.need(4); err != nil {
+		return 0, err
+	}
+	v := binary.LittleEndian.Uint32(p.chunk.data[p.pos:])
+	p.pos += 4
+	return v, nil
+}
+
+func (p *evtxParser) bytes(n int) ([]byte, error) {
+	if err := p.need(n); err != nil {
+		return nil, err
+	}
+	v := p.chunk.data[p.pos : p.pos+n]
+	p.pos += n
+	return v, nil
+}
+
+// name : チャンク内の名前を取得する。名前が直後にある場合は読み飛ばす
+func (p *evtxParser) name(nodeStart int) (string, error) {
+	off, err := p.u32()
+	if err != nil {
+		return "", err
+	}
+	d := p.chunk.data
+	if int(off)+8 > len(d) {
+		return "", errEvtxShort
+	}
+	n := int(binary.LittleEndian.Uint16(d[off+6:]))
+	if int(off)+8+n*2 > len(d) {
+		return "", errEvtxShort
+	}
+	s := decodeUTF16LE(d[off+8 : int(off)+8+n*2])
+	if int(off) > nodeStart {
+		if _, err := p.bytes(8 + n*2 + 2); err != nil {
+			return "", err
+		}
+	}
+	return s, nil
+}
+
+// render : BinXMLをXMLの文字列にする
+func (p *evtxParser) render(sb *strings.Builder, values []evtxValue) error {
+	stack := []string{}
+	inStart := false
+	for p.pos < p.end {
+		nodeStart := p.pos
+		tok, err := p.u8()
+		if err != nil {
+			return err
+		}
+		switch tok &^ binXMLMoreBit {
+		case binXMLEOF:
+			return nil
+		case binXMLFragmentHeader:
+			if _, err := p.bytes(3); err != nil {
+				return err
+			}
+		case binXMLOpenStartElement:
+			if _, err := p.bytes(6); err != nil {
+				return err
+			}
+			n, err := p.name(nodeStart)
+			if err != nil {
+				return err
+			}
+			if tok&binXMLMoreBit != 0 {
+				if _, err := p.u32(); err != nil {
+					return err
+				}
+			}
+			sb.WriteString("<" + n)
+			stack = append(stack, n)
+			inStart = true
+		case binXMLAttribute:
+			n, err := p.name(nodeStart)
+			if err != nil {
+				return err
+			}
+			v, ok, err := p.attributeValue(values)
+			if err != nil {
+				return err
+			}
+			if ok {
+				sb.WriteString(" " + n + "='" + escapeEvtxXML(v) + "'")
+			}
+		case binXMLCloseStartElement:
+			sb.WriteString(">")
+			inStart = false
+		case binXMLCloseEmptyElement:
+			sb.WriteString("/>")
+			inStart = false
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case binXMLEndElement:
+			if len(stack) < 1 {
+				return fmt.Errorf("evtx bad end element")
+			}
+			sb.WriteString("</" + stack[len(stack)-1] + ">")
+			stack = stack[:len(stack)-1]
+		case binXMLValue:
+			v, err := p.inlineValue()
+			if err != nil {
+				return err
+			}
+			sb.WriteString(escapeEvtxXML(v))
+		case binXMLCDATA:
+			n, err := p.u16()
+			if err != nil {
+				return err
+			}
+			b, err := p.bytes(int(n) * 2)
+			if err != nil {
+				return err
+			}
+			sb.WriteString("<![CDATA[" + decodeUTF16LE(b) + "]]>")
+		case binXMLCharRef:
+			v, err := p.u16()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(sb, "&#%d;", v)
+		case binXMLEntityRef:
+			n, err := p.name(nodeStart)
+			if err != nil {
+				return err
+			}
+			sb.WriteString("&" + n + ";")
+		case binXMLPITarget:
+			n, err := p.name(nodeStart)
+			if err != nil {
+				return err
+			}
+			sb.WriteString("<?" + n)
+		case binXMLPIData:
+			n, err := p.u16()
+			if err != nil {
+				return err
+			}
+			b, err := p.bytes(int(n) * 2)
+			if err != nil {
+				return err
+			}
+			sb.WriteString(" " + decodeUTF16LE(b) + "?>")
+		case binXMLTemplateInstance:
+			if err := p.templateInstance(sb, nodeStart); err != nil {
+				return err
+			}
+		case binXMLNormalSubstitution, binXMLOptionalSubstitution:
+			id, err := p.u16()
+			if err != nil {
+				return err
+			}
+			if _, err := p.u8(); err != nil {
+				return err
+			}
+			if int(id) < len(values) {
+				if err := p.writeValue(sb, values[id]); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("evtx unknown token 0x%02x at %d", tok, nodeStart)
+		}
+	}
+	if inStart || len(stack) > 0 {
+		return fmt.Errorf("evtx unterminated element")
+	}
+	return nil
+}
+
+// attributeValue : 属性の値を取得する。値のないオプションは属性ごと省略する
+func (p *evtxParser) attributeValue(values []evtxValue) (string, bool, error) {
+	tok, err := p.u8()
+	if err != nil {
+		return "", false, err
+	}
+	switch tok &^ binXMLMoreBit {
+	case binXMLValue:
+		v, err := p.inlineValue()
+		return v, true, err
+	case binXMLNormalSubstitution, binXMLOptionalSubstitution:
+		id, err := p.u16()
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := p.u8(); err != nil {
+			return "", false, err
+		}
+		if int(id) >= len(values) || values[id].vtype == evtxTypeNull {
+			return "", tok == binXMLNormalSubstitution, nil
+		}
+		v, err := formatEvtxValue(values[id])
+		return v, true, err
+	case binXMLCharRef:
+		v, err := p.u16()
+		return string(rune(v)), true, err
+	}
+	return "", false, fmt.Errorf("evtx bad attribute value token 0x%02x", tok)
+}
+
+func (p *evtxParser) inlineValue() (string, error) {
+	t, err := p.u8()
+	if err != nil {
+		return "", err
+	}
+	if t != evtxTypeString {
+		return "", fmt.Errorf("evtx bad value type 0x%02x", t)
+	}
+	n, err := p.u16()
+	if err != nil {
+		return "", err
+	}
+	b, err := p.bytes(int(n) * 2)
+	if err != nil {
+		return "", err
+	}
+	return decodeUTF16LE(b), nil
+}
+
+// templateInstance : テンプレートと置換する値を読み込んで出力する
+func (p *evtxParser) templateInstance(sb *strings.Builder, nodeStart int) error {
+	if _, err := p.bytes(5); err != nil {
+		return err
+	}
+	off, err := p.u32()
+	if err != nil {
+		return err
+	}
+	d := p.chunk.data
+	if int(off)+24 > len(d) {
+		return errEvtxShort
+	}
+	size := int(binary.LittleEndian.Uint32(d[off+20:]))
+	tStart := int(off) + 24
+	if tStart+size > len(d) {
+		return errEvtxShort
+	}
+	if int(off) > nodeStart {
+		// テンプレートの定義がここにある
+		if _, err := p.bytes(24 + size); err != nil {
+			return err
+		}
+	}
+	n, err := p.u32()
+	if err != nil {
+		return err
+	}
+	if n > 4096 {
+		return fmt.Errorf("evtx too many substitutions %d", n)
+	}
+	values := make([]evtxValue, n)
+	sizes := make([]int, n)
+	for i := range values {
+		s, err := p.u16()
+		if err != nil {
+			return err
+		}
+		t, err := p.u8()
+		if err != nil {
+			return err
+		}
+		if _, err := p.u8(); err != nil {
+			return err
+		}
+		sizes[i] = int(s)
+		values[i].vtype = t
+	}
+	for i := range values {
+		values[i].off = p.pos
+		b, err := p.bytes(sizes[i])
+		if err != nil {
+			return err
+		}
+		values[i].data = b
+	}
+	tp := &evtxParser{chunk: p.chunk, pos: tStart, end: tStart + size}
+	return tp.render(sb, values)
+}
+
+func (p *evtxParser) writeValue(sb *strings.Builder, v evtxValue) error {
+	if v.vtype == evtxTypeBinXML {
+		// 値の中のBinXMLも同じチャンクの位置として出力する
+		np := &evtxParser{chunk: p.chunk, pos: v.off, end: v.off + len(v.data)}
+		return np.render(sb, nil)
+	}
+	s, err := formatEvtxValue(v)
+	if err != nil {
+		return err
+	}
+	sb.WriteString(escapeEvtxXML(s))
+	return nil
+}
+
+// formatEvtxValue : 値をwevtutilと同じ形式の文字列にする
+func formatEvtxValue(v evtxValue) (string, error) {
+	d := v.data
+	if v.vtype&evtxTypeArray != 0 {
+		return formatEvtxArray(v)
+	}
+	need := map[byte]int{
+		evtxTypeInt8: 1, evtxTypeUInt8: 1, evtxTypeInt16: 2, evtxTypeUInt16: 2,
+		evtxTypeInt32: 4, evtxTypeUInt32: 4, evtxTypeHexInt32: 4, evtxTypeBool: 4, evtxTypeReal32: 4,
+		evtxTypeInt64: 8, evtxTypeUInt64: 8, evtxTypeHexInt64: 8, evtxTypeReal64: 8, evtxTypeFileTime: 8,
+		evtxTypeGUID: 16, evtxTypeSysTime: 16,
+	}
+	if n, ok := need[v.vtype]; ok && len(d) < n {
+		return "", errEvtxShort
+	}
+	switch v.vtype {
+	case evtxTypeNull:
+		return "", nil
+	case evtxTypeString:
+		return strings.TrimRight(decodeUTF16LE(d), "\x00"), nil
+	case evtxTypeAnsiString:
+		return strings.TrimRight(string(d), "\x00"), nil
+	case evtxTypeInt8:
+		return fmt.Sprintf("%d", int8(d[0])), nil
+	case evtxTypeUInt8:
+		return fmt.Sprintf("%d", d[0]), nil
+	case evtxTypeInt16:
+		return fmt.Sprintf("%d", int16(binary.LittleEndian.Uint16(d))), nil
+	case evtxTypeUInt16:
+		return fmt.Sprintf("%d", binary.LittleEndian.Uint16(d)), nil
+	case evtxTypeInt32:
+		return fmt.Sprintf("%d", int32(binary.LittleEndian.Uint32(d))), nil
+	case evtxTypeUInt32:
+		return fmt.Sprintf("%d", binary.LittleEndian.Uint32(d)), nil
+	case evtxTypeInt64:
+		return fmt.Sprintf("%d", int64(binary.LittleEndian.Uint64(d))), nil
+	case evtxTypeUInt64:
+		return fmt.Sprintf("%d", binary.LittleEndian.Uint64(d)), nil
+	case evtxTypeHexInt32:
+		return fmt.Sprintf("0x%x", binary.LittleEndian.Uint32(d)), nil
+	case evtxTypeHexInt64:
+		return fmt.Sprintf("0x%x", binary.LittleEndian.Uint64(d)), nil
+	case evtxTypeReal32:
+		return fmt.Sprintf("%g", math.Float32frombits(binary.LittleEndian.Uint32(d))), nil
+	case evtxTypeReal64:
+		return fmt.Sprintf("%g", math.Float64frombits(binary.LittleEndian.Uint64(d))), nil
+	case evtxTypeBool:
+		if binary.LittleEndian.Uint32(d) != 0 {
+			return "true", nil
+		}
+		return "false", nil
+	case evtxTypeBinary:
+		return strings.ToUpper(hex.EncodeToString(d)), nil
+	case evtxTypeGUID:
+		return fmt.Sprintf("{%08X-%04X-%04X-%X-%X}",
+			binary.LittleEndian.Uint32(d), binary.LittleEndian.Uint16(d[4:]),
+			binary.LittleEndian.Uint16(d[6:]), d[8:10], d[10:16]), nil
+	case evtxTypeSizeT:
+		if len(d) == 4 {
+			return fmt.Sprintf("0x%x", binary.LittleEndian.Uint32(d)), nil
+		}
+		if len(d) == 8 {
+			return fmt.Sprintf("0x%x", binary.LittleEndian.Uint64(d)), nil
+		}
+		return "", errEvtxShort
+	case evtxTypeFileTime:
+		return formatFileTime(binary.LittleEndian.Uint64(d)), nil
+	case evtxTypeSysTime:
+		t := time.Date(int(binary.LittleEndian.Uint16(d)), time.Month(binary.LittleEndian.Uint16(d[2:])),
+			int(binary.LittleEndian.Uint16(d[6:])), int(binary.LittleEndian.Uint16(d[8:])),
+			int(binary.LittleEndian.Uint16(d[10:])), int(binary.LittleEndian.Uint16(d[12:])),
+			int(binary.LittleEndian.Uint16(d[14:]))*int(time.Millisecond), time.UTC)
+		return t.Format("2006-01-02T15:04:05.000Z"), nil
+	case evtxTypeSID:
+		return formatSID(d)
+	}
+	return strings.ToUpper(hex.EncodeToString(d)), nil
+}
+
+// formatEvtxArray : 配列の値を空白区切りにする
+func formatEvtxArray(v evtxValue) (string, error) {
+	t := v.vtype &^ evtxTypeArray
+	if t == evtxTypeString {
+		a := strings.Split(strings.TrimRight(decodeUTF16LE(v.data), "\x00"), "\x00")
+		return strings.Join(a, " "), nil
+	}
+	size := map[byte]int{
+		evtxTypeInt8: 1, evtxTypeUInt8: 1, evtxTypeInt16: 2, evtxTypeUInt16: 2,
+		evtxTypeInt32: 4, evtxTypeUInt32: 4, evtxTypeHexInt32: 4, evtxTypeBool: 4, evtxTypeReal32: 4,
+		evtxTypeInt64: 8, evtxTypeUInt64: 8, evtxTypeHexInt64: 8, evtxTypeReal64: 8, evtxTypeFileTime: 8,
+		evtxTypeGUID: 16, evtxTypeSysTime: 16,
+	}[t]
+	if size < 1 {
+		return strings.ToUpper(hex.EncodeToString(v.data)), nil
+	}
+	a := []string{}
+	for i := 0; i+size <= len(v.data); i += size {
+		s, err := formatEvtxValue(evtxValue{vtype: t, data: v.data[i : i+size]})
+		if err != nil {
+			return "", err
+		}
+		a = append(a, s)
+	}
+	return strings.Join(a, " "), nil
+}
+
+func formatFileTime(ft uint64) string {
+	// 1601-01-01からの100ナノ秒単位
+	const epochDiff = 116444736000000000
+	if ft < epochDiff {
+		return ""
+	}
+	ft -= epochDiff
+	t := time.Unix(int64(ft/10000000), int64(ft%10000000)*100).UTC()
+	return t.Format("2006-01-02T15:04:05.0000000Z")
+}
+
+func formatSID(d []byte) (string, error) {
+	if len(d) < 8 {
+		return "", errEvtxShort
+	}
+	n := int(d[1])
+	if len(d) < 8+n*4 {
+		return "", errEvtxShort
+	}
+	var auth uint64
+	for _, b := range d[2:8] {
+		auth = auth<<8 | uint64(b)
+	}
+	s := fmt.Sprintf("S-%d-%d", d[0], auth)
+	for i := 0; i < n; i++ {
+		s += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(d[8+i*4:]))
+	}
+	return s, nil
+}
+
+func decodeUTF16LE(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+var evtxXMLEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "'", "&apos;", "\"", "&quot;")
+
+func escapeEvtxXML(s string) string {
+	return evtxXMLEscaper.Replace(s)
+}
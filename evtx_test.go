@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/Security.evtxは4625と4688の2件のレコード。2件目はSecurityのUserIDがない
+func TestReadEvtx(t *testing.T) {
+	list := []string{}
+	n, err := readEvtx(filepath.Join("testdata", "Security.evtx"), func(x string) {
+		list = append(list, x)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(list) != 2 {
+		t.Fatalf("records=%d callbacks=%d want 2", n, len(list))
+	}
+	tests := []struct {
+		eventID  int
+		recordID int64
+		time     string
+		userID   string
+		data     map[string]string
+	}{
+		{
+			eventID:  4625,
+			recordID: 11,
+			time:     "2025-01-22T06:13:20.1234567Z",
+			userID:   "S-1-5-21-1-2-3-1104",
+			data: map[string]string{
+				"TargetUserName": "bob",
+				"SubStatus":      "0xc000006a",
+				"LogonType":      "3",
+				"IpAddress":      "10.1.1.1",
+			},
+		},
+		{
+			eventID:  4688,
+			recordID: 12,
+			time:     "2025-01-22T06:13:21.1234567Z",
+			data: map[string]string{
+				"SubjectUserName":   "alice",
+				"NewProcessName":    `C:\Windows\System32\cmd.exe`,
+				"CommandLine":       `cmd /c "a & b"`,
+				"ParentProcessName": `C:\Windows\explorer.exe`,
+			},
+		},
+	}
+	for i, tt := range tests {
+		ev := new(Event)
+		if err := xml.Unmarshal([]byte(list[i]), ev); err != nil {
+			t.Fatalf("record %d xml err=%v\n%s", i, err, list[i])
+		}
+		s := ev.System
+		if s.EventID != tt.eventID || s.EventRecordID != tt.recordID {
+			t.Errorf("record %d eventID=%d recordID=%d", i, s.EventID, s.EventRecordID)
+		}
+		if s.Provider.Name != "Microsoft-Windows-Security-Auditing" || s.Channel != "Security" || s.Computer != "DC01.contoso.local" {
+			t.Errorf("record %d system=%+v", i, s)
+		}
+		if s.TimeCreated.SystemTime != tt.time {
+			t.Errorf("record %d time=%s want %s", i, s.TimeCreated.SystemTime, tt.time)
+		}
+		if s.Security.UserID != tt.userID {
+			t.Errorf("record %d userID=%s want %s", i, s.Security.UserID, tt.userID)
+		}
+		for k, v := range tt.data {
+			if got := ev.Get(k); got != v {
+				t.Errorf("record %d %s=%q want %q", i, k, got, v)
+			}
+		}
+	}
+}
+
+func TestReadEvtxNotEvtx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.evtx")
+	if err := os.WriteFile(path, []byte("<Events></Events>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readEvtx(path, func(string) {}); err == nil {
+		t.Error("no error for not evtx file")
+	}
+}
+
+func TestFormatEvtxValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		vtype byte
+		data  []byte
+		want  string
+	}{
+		{"string", evtxTypeString, []byte{'a', 0, 'b', 0, 0, 0}, "ab"},
+		{"int8", evtxTypeInt8, []byte{0xff}, "-1"},
+		{"uint16", evtxTypeUInt16, []byte{0x45, 0x12}, "4677"},
+		{"hexInt32", evtxTypeHexInt32, []byte{0x6a, 0, 0, 0xc0}, "0xc000006a"},
+		{"bool", evtxTypeBool, []byte{1, 0, 0, 0}, "true"},
+		{"sid", evtxTypeSID, []byte{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0}, "S-1-5-18"},
+		{"fileTime", evtxTypeFileTime, []byte{0x00, 0x80, 0x3e, 0xd5, 0xde, 0xb1, 0x9d, 0x01}, "1970-01-01T00:00:00.0000000Z"},
+		{"stringArray", evtxTypeArray | evtxTypeString, []byte{'a', 0, 0, 0, 'b', 0, 0, 0}, "a b"},
+		{"uint16Array", evtxTypeArray | evtxTypeUInt16, []byte{1, 0, 2, 0}, "1 2"},
+	}
+	for _, tt := range tests {
+		got, err := formatEvtxValue(evtxValue{vtype: tt.vtype, data: tt.data})
+		if err != nil {
+			t.Errorf("%s err=%v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s=%q want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := formatEvtxValue(evtxValue{vtype: evtxTypeUInt32, data: []byte{1}}); err == nil {
+		t.Error("no error for short uint32")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// filterRuleEnt : 正規表現でイベントと送信するレコードを選別するルール
+type filterRuleEnt struct {
+	Name     string
+	Match    map[string]*regexp.Regexp
+	Action   string
+	Severity int
+	Event    bool
+	Output   bool
+	Dropped  atomic.Int64
+}
+
+// filterRules : 再読み込みで入れ替えるのでロックなしで読めるようにする
+var filterRules atomic.Pointer[[]*filterRuleEnt]
+
+func getFilterRules() []*filterRuleEnt {
+	if p := filterRules.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// filterFieldAlias : 複数の項目にまたがるフィールド名
+var filterFieldAlias = map[string][]string{
+	"user":    {"TargetUserName", "SubjectUserName", "target", "subject", "last_subject", "user"},
+	"ip":      {"IpAddress", "ip"},
+	"process": {"NewProcessName", "ProcessName", "Image", "process"},
+	"eventID": {"eventID", "event_id"},
+}
+
+// newFilterRule : 設定ファイルのルールをコンパイルする
+func newFilterRule(name string, match map[string]string, action string, severity int, stage string) (*filterRuleEnt, error) {
+	r := &filterRuleEnt{
+		Name:     name,
+		Match:    make(map[string]*regexp.Regexp),
+		Action:   action,
+		Severity: severity,
+	}
+	if len(match) < 1 {
+		return nil, fmt.Errorf("match: no field")
+	}
+	for k, v := range match {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("match.%s: %v", k, err)
+		}
+		r.Match[k] = re
+	}
+	switch action {
+	case "drop", "keep":
+	case "severity":
+		if severity < 0 || severity > 7 {
+			return nil, fmt.Errorf("severity: must be 0-7")
+		}
+	default:
+		return nil, fmt.Errorf("action: must be drop, keep or severity")
+	}
+	switch stage {
+	case "", "both":
+		r.Event = true
+		r.Output = true
+	case "event":
+		r.Event = true
+	case "output":
+		r.Output = true
+	default:
+		return nil, fmt.Errorf("stage: must be event, output or both")
+	}
+	return r, nil
+}
+
+func (r *filterRuleEnt) match(get func(string) []string) bool {
+	for k, re := range r.Match {
+		names, ok := filterFieldAlias[k]
+		if !ok {
+			names = []string{k}
+		}
+		hit := false
+		for _, n := range names {
+			for _, v := range get(n) {
+				if re.MatchString(v) {
+					hit = true
+					break
+				}
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFilter : 最初に一致したルールを返す
+func checkFilter(output bool, get func(string) []string) *filterRuleEnt {
+	for _, r := range getFilterRules() {
+		if (output && !r.Output) || (!output && !r.Event) {
+			continue
+		}
+		if r.match(get) {
+			if r.Action == "drop" {
+				r.Dropped.Add(1)
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+// filterEvent : ハンドラーに渡す前のイベントを選別する
+func filterEvent(ev *Event) bool {
+	if len(getFilterRules()) < 1 {
+		return true
+	}
+	r := checkFilter(false, func(n string) []string {
+		switch n {
+		case "channel":
+			return []string{ev.System.Channel}
+		case "provider":
+			return []string{ev.System.Provider.Name}
+		case "eventID":
+			return []string{strconv.Itoa(ev.System.EventID)}
+		case "computer":
+			return []string{ev.System.Computer}
+		}
+		if v := ev.Get(n); v != "" {
+			return []string{v}
+		}
+		return nil
+	})
+	return r == nil || r.Action != "drop"
+}
+
+// filterSyslog : 送信するsyslogを選別して重要度を変更する
+func filterSyslog(msg *syslogEnt) bool {
+	if len(getFilterRules()) < 1 {
+		return true
+	}
+	kv := make(map[string]string)
+	if len(msg.Fields) > 0 {
+		for _, e := range msg.Fields {
+			kv[e.Key] = e.Value
+		}
+	} else {
+		kv = parseSyslogKV(msg.Msg)
+	}
+	r := checkFilter(true, func(n string) []string {
+		if v, ok := kv[n]; ok {
+			if n == "subject" || n == "target" {
+				return []string{v, strings.SplitN(v, "@", 2)[0]}
+			}
+			return []string{v}
+		}
+		return nil
+	})
+	if r == nil {
+		return true
+	}
+	switch r.Action {
+	case "drop":
+		return false
+	case "severity":
+		msg.Severity = r.Severity
+	}
+	return true
+}
+
+// filterMQTT : 送信するMQTTのデータを選別して重要度を変更する
+func filterMQTT(msg interface{}) bool {
+	if len(getFilterRules()) < 1 {
+		return true
+	}
+	m := make(map[string]interface{})
+	if j, err := json.Marshal(msg); err == nil {
+		json.Unmarshal(j, &m)
+	}
+	r := checkFilter(true, func(n string) []string {
+		if n == "type" {
+			if v, ok := m["type"]; ok {
+				return []string{fmt.Sprint(v)}
+			}
+			return []string{getMqttType(msg)}
+		}
+		if v, ok := m[n]; ok {
+			s := fmt.Sprint(v)
+			if n == "subject" || n == "target" || n == "last_subject" {
+				return []string{s, strings.SplitN(s, "@", 2)[0]}
+			}
+			return []string{s}
+		}
+		return nil
+	})
+	if r == nil {
+		return true
+	}
+	switch r.Action {
+	case "drop":
+		return false
+	case "severity":
+		level := getLevelBySeverity(r.Severity)
+		switch e := msg.(type) {
+		case *mqttMessageDataEnt:
+			e.Level = level
+		case *mqttEventIDDataEnt:
+			e.Level = level
+		}
+	}
+	return true
+}
+
+// parseSyslogKV : type=Logon,subject=...の形式のメッセージを分解する
+func parseSyslogKV(s string) map[string]string {
+	ret := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		a := strings.SplitN(kv, "=", 2)
+		if len(a) == 2 {
+			ret[a[0]] = a[1]
+		}
+	}
+	return ret
+}
+
+func getLevelBySeverity(sv int) string {
+	switch {
+	case sv <= 2:
+		return "CRIT"
+	case sv == 3:
+		return "ERROR"
+	case sv == 4:
+		return "WARN"
+	}
+	return "INFO"
+}
+
+// getFilterStats : ルールごとに除外した数
+func getFilterStats() string {
+	a := []string{}
+	for _, r := range getFilterRules() {
+		if r.Action == "drop" {
+			a = append(a, fmt.Sprintf("%s=%d", r.Name, r.Dropped.Load()))
+		}
+	}
+	return strings.Join(a, ",")
+}
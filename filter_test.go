@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+)
+
+type testFilterRuleEnt struct {
+	name     string
+	match    map[string]string
+	action   string
+	severity int
+	stage    string
+}
+
+func setTestFilterRules(t *testing.T, list []testFilterRuleEnt) {
+	rules := []*filterRuleEnt{}
+	for _, f := range list {
+		r, err := newFilterRule(f.name, f.match, f.action, f.severity, f.stage)
+		if err != nil {
+			t.Fatalf("%s err=%v", f.name, err)
+		}
+		rules = append(rules, r)
+	}
+	filterRules.Store(&rules)
+}
+
+// 最初に一致したルールを使うのでkeepを先に書くとdropより優先する
+func TestFilterEventOrder(t *testing.T) {
+	defer filterRules.Store(nil)
+	setTestFilterRules(t, []testFilterRuleEnt{
+		{"keepAdmin", map[string]string{"user": "^(?i)admin$"}, "keep", 0, ""},
+		{"dropLogon", map[string]string{"eventID": "^4624$", "channel": "^Security$"}, "drop", 0, "event"},
+		{"dropMachine", map[string]string{"user": `\$$`}, "drop", 0, ""},
+		{"dropApp", map[string]string{"provider": "^Application Error$"}, "drop", 0, "both"},
+	})
+	tests := []struct {
+		name    string
+		channel string
+		eventID int
+		data    map[string]string
+		want    bool
+	}{
+		{"keep before drop", "Security", 4624, map[string]string{"TargetUserName": "Admin"}, true},
+		{"drop logon", "Security", 4624, map[string]string{"TargetUserName": "bob"}, false},
+		{"all fields must match", "System", 4624, map[string]string{"TargetUserName": "bob"}, true},
+		{"other event", "Security", 4625, map[string]string{"TargetUserName": "bob"}, true},
+		{"alias subject", "Security", 4688, map[string]string{"SubjectUserName": "PC01$"}, false},
+		{"no rule", "Security", 4688, map[string]string{"SubjectUserName": "bob"}, true},
+	}
+	for _, tt := range tests {
+		if got := filterEvent(newTestEvent(tt.channel, tt.eventID, tt.data)); got != tt.want {
+			t.Errorf("%s=%v want %v", tt.name, got, tt.want)
+		}
+	}
+	ev := newTestEvent("Application", 1000, nil)
+	ev.System.Provider.Name = "Application Error"
+	if filterEvent(ev) {
+		t.Error("provider not dropped")
+	}
+	if s := getFilterStats(); s != "dropLogon=1,dropMachine=1,dropApp=1" {
+		t.Errorf("stats=%s", s)
+	}
+}
+
+// eventのルールはイベント、outputのルールは送信するレコードだけに使う
+func TestFilterStage(t *testing.T) {
+	defer filterRules.Store(nil)
+	setTestFilterRules(t, []testFilterRuleEnt{
+		{"eventOnly", map[string]string{"eventID": "^4624$"}, "drop", 0, "event"},
+		{"outputOnly", map[string]string{"computer": "^PC01$"}, "drop", 0, "output"},
+	})
+	if filterEvent(newTestEvent("Security", 4624, nil)) {
+		t.Error("event stage rule not applied to event")
+	}
+	ev := newTestEvent("Security", 4625, nil)
+	ev.System.Computer = "PC01"
+	if !filterEvent(ev) {
+		t.Error("output stage rule applied to event")
+	}
+	tests := []struct {
+		name string
+		msg  *syslogEnt
+		want bool
+	}{
+		{"event stage", &syslogEnt{Fields: newSyslogFields("type", "EventID", "computer", "PC02", "eventID", 4624)}, true},
+		{"output stage", &syslogEnt{Fields: newSyslogFields("type", "EventID", "computer", "PC01", "eventID", 4625)}, false},
+		{"output stage msg", &syslogEnt{Msg: "type=Logon,computer=PC01,target=bob"}, false},
+	}
+	for _, tt := range tests {
+		if got := filterSyslog(tt.msg); got != tt.want {
+			t.Errorf("%s=%v want %v", tt.name, got, tt.want)
+		}
+	}
+	if filterMQTT(&mqttEventIDDataEnt{Computer: "PC01", EventID: 1}) {
+		t.Error("output stage rule not applied to mqtt")
+	}
+}
+
+func TestFilterSeverity(t *testing.T) {
+	defer filterRules.Store(nil)
+	setTestFilterRules(t, []testFilterRuleEnt{
+		{"adminFailed", map[string]string{"type": "^LogonFailed$", "user": "^admin$"}, "severity", 2, "output"},
+		{"appEvents", map[string]string{"type": "^EventID$", "channel": "^Application$"}, "drop", 0, "output"},
+		{"logon", map[string]string{"type": "^Logon$"}, "severity", 4, ""},
+	})
+	tests := []struct {
+		name     string
+		msg      *syslogEnt
+		want     bool
+		severity int
+	}{
+		{"subject without domain", &syslogEnt{Severity: 4,
+			Fields: newSyslogFields("type", "LogonFailed", "target", "admin@CONTOSO", "ip", "10.0.0.1")}, true, 2},
+		{"other user", &syslogEnt{Severity: 4,
+			Fields: newSyslogFields("type", "LogonFailed", "target", "bob@CONTOSO")}, true, 4},
+		{"drop", &syslogEnt{Severity: 6, Fields: newSyslogFields("type", "EventID", "channel", "Application")}, false, 6},
+		{"keep other channel", &syslogEnt{Severity: 6, Fields: newSyslogFields("type", "EventID", "channel", "System")}, true, 6},
+		{"msg", &syslogEnt{Severity: 6, Msg: "type=Logon,target=bob@CONTOSO"}, true, 4},
+	}
+	for _, tt := range tests {
+		if got := filterSyslog(tt.msg); got != tt.want || tt.msg.Severity != tt.severity {
+			t.Errorf("%s=%v,%d want %v,%d", tt.name, got, tt.msg.Severity, tt.want, tt.severity)
+		}
+	}
+	m := &mqttMessageDataEnt{Level: "INFO", Type: "Logon"}
+	if !filterMQTT(m) || m.Level != "WARN" {
+		t.Errorf("mqtt level=%s", m.Level)
+	}
+	if filterMQTT(&mqttEventIDDataEnt{Channel: "Application", Level: "INFO"}) {
+		t.Error("mqtt not dropped")
+	}
+	e := &mqttEventIDDataEnt{Channel: "System", Level: "INFO"}
+	if !filterMQTT(e) || e.Level != "INFO" {
+		t.Errorf("mqtt level=%s", e.Level)
+	}
+}
+
+func TestNewFilterRuleError(t *testing.T) {
+	tests := []testFilterRuleEnt{
+		{"no match", map[string]string{}, "drop", 0, ""},
+		{"bad regexp", map[string]string{"user": "("}, "drop", 0, ""},
+		{"bad action", map[string]string{"user": "a"}, "delete", 0, ""},
+		{"bad severity", map[string]string{"user": "a"}, "severity", 8, ""},
+		{"bad stage", map[string]string{"user": "a"}, "drop", 0, "input"},
+	}
+	for _, tt := range tests {
+		if _, err := newFilterRule(tt.name, tt.match, tt.action, tt.severity, tt.stage); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
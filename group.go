@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// セキュリティグループのメンバーの変更を記録する
+
+type groupEnt struct {
+	Action    string
+	Subject   string
+	Member    string
+	Group     string
+	Scope     string
+	Computer  string
+	Count     int
+	FirstTime int64
+	LastTime  int64
+}
+
+// <Data Name="MemberName">CN=Bob,OU=Users,DC=contoso,DC=local</Data>
+// <Data Name="MemberSid">S-1-5-21-3457937927-2839227994-823803824-1105</Data>
+// <Data Name="TargetUserName">Domain Admins</Data>
+// <Data Name="TargetDomainName">CONTOSO</Data>
+// <Data Name="TargetSid">S-1-5-21-3457937927-2839227994-823803824-512</Data>
+// <Data Name="SubjectUserName">dadmin</Data>
+// <Data Name="SubjectDomainName">CONTOSO</Data>
+
+func (e *groupEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Group", "action", e.Action, "subject", e.Subject, "member", e.Member,
+		"group", e.Group, "scope", e.Scope, "computer", e.Computer, "count", e.Count,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
+	)
+}
+
+var groupMap sync.Map
+var groupCount atomic.Int64
+
+func updateGroup(ev *Event, t time.Time) {
+	action := "Added"
+	scope := ""
+	switch ev.System.EventID {
+	case 4728:
+		scope = "Global"
+	case 4729:
+		action = "Removed"
+		scope = "Global"
+	case 4732:
+		scope = "Local"
+	case 4733:
+		action = "Removed"
+		scope = "Local"
+	case 4756:
+		scope = "Universal"
+	case 4757:
+		action = "Removed"
+		scope = "Universal"
+	default:
+		return
+	}
+	subject := fmt.Sprintf("%s@%s", ev.Get("SubjectUserName"), ev.Get("SubjectDomainName"))
+	member := getMemberName(ev.Get("MemberName"))
+	if member == "" {
+		// ローカルのアカウントはSIDだけ
+		member = ev.Get("MemberSid")
+	}
+	groupName := ev.Get("TargetUserName")
+	group := fmt.Sprintf("%s@%s", groupName, ev.Get("TargetDomainName"))
+	ts := t.Unix()
+	if isPrivilegedGroup(groupName, ev.Get("TargetSid")) {
+		sendAlert("PrivilegedGroupChange", ev.System.Computer, t,
+			"action", action, "group", group, "scope", scope, "member", member, "subject", subject,
+			"eventID", ev.System.EventID)
+	}
+	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s:%s", action, group, member, ev.System.Computer))
+	if v, ok := groupMap.Load(id); ok {
+		if e, ok := v.(*groupEnt); ok {
+			e.Count++
+			e.Subject = subject
+			if e.LastTime < ts {
+				e.LastTime = ts
+			}
+		}
+		return
+	}
+	groupMap.Store(id, &groupEnt{
+		Action:    action,
+		Subject:   subject,
+		Member:    member,
+		Group:     group,
+		Scope:     scope,
+		Computer:  ev.System.Computer,
+		Count:     1,
+		FirstTime: ts,
+		LastTime:  ts,
+	})
+}
+
+// getMemberName : CN=Bob,OU=...からBobを取り出す
+func getMemberName(dn string) string {
+	if !strings.HasPrefix(strings.ToUpper(dn), "CN=") {
+		return dn
+	}
+	s := dn[3:]
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ',':
+			return strings.ReplaceAll(s[:i], "\\", "")
+		}
+	}
+	return strings.ReplaceAll(s, "\\", "")
+}
+
+// isPrivilegedGroup : グループ名、SID、-512のようなRIDで比較する
+func isPrivilegedGroup(name, sid string) bool {
+	for _, g := range privilegedGroupList {
+		switch {
+		case strings.HasPrefix(g, "-"):
+			if sid != "" && strings.HasSuffix(sid, g) {
+				return true
+			}
+		case strings.HasPrefix(strings.ToUpper(g), "S-1-"):
+			if strings.EqualFold(g, sid) {
+				return true
+			}
+		default:
+			if strings.EqualFold(g, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sendGroup() {
+	groupMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*groupEnt); ok {
+			if debug {
+				log.Printf("group id=%s,e=%v", k, e)
+			}
+			groupCount.Add(1)
+			sendSyslog(&syslogEnt{
+				Severity: 6,
+				Time:     time.Now(),
+				Fields:   e.Fields(),
+			})
+			publishMQTT(&mqttGroupDataEnt{
+				Time:      time.Now().Format(time.RFC3339),
+				Action:    e.Action,
+				Subject:   e.Subject,
+				Member:    e.Member,
+				Group:     e.Group,
+				Scope:     e.Scope,
+				Computer:  e.Computer,
+				Count:     e.Count,
+				FirstTime: time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+				LastTime:  time.Unix(e.LastTime, 0).Format(time.RFC3339),
+			})
+			groupMap.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var httpAddr = ""
+
+// startHTTP : メトリクスと状態の確認、操作のAPIを提供するHTTPサーバー
+func startHTTP(ctx context.Context) {
+	if httpAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /status", statusHandler)
+	mux.HandleFunc("GET /aggregates/{type}", aggregatesHandler)
+	mux.HandleFunc("POST /flush", flushHandler)
+	mux.HandleFunc("POST /reload", reloadHandler)
+	srv := &http.Server{
+		Addr:              httpAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		<-ctx.Done()
+		c, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(c)
+	}()
+	log.Printf("start http addr=%s", httpAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("http err=%v", err)
+	}
+}
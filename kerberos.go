@@ -1,5 +1,3 @@
-//go:build windows
-
 package main
 
 import (
@@ -20,6 +18,9 @@ type kerberosEnt struct {
 	Failed     int
 	LastStatus string
 	LastCert   string
+	EncType    string
+	Options    string
+	PreAuth    string
 	FirstTime  int64
 	LastTime   int64
 }
@@ -58,40 +59,46 @@ TGT
 </EventData>
 */
 
-func (e *kerberosEnt) String() string {
-	return fmt.Sprintf("type=Kerberos,target=%s,computer=%s,ip=%s,service=%s,ticketType=%s,count=%d,failed=%d,status=%s,cert=%s,ft=%s,lt=%s",
-		e.Target, e.Computer, e.IP, e.Service, e.TicketType, e.Count, e.Failed,
-		e.LastStatus, e.LastCert,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339),
+func (e *kerberosEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Kerberos", "target", e.Target, "computer", e.Computer, "ip", e.IP,
+		"service", e.Service, "ticketType", e.TicketType, "count", e.Count, "failed", e.Failed,
+		"status", e.LastStatus, "cert", e.LastCert,
+		"encType", e.EncType, "ticketOptions", e.Options, "preAuth", e.PreAuth,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
 	)
 }
 
 var kerberosMap sync.Map
 
-func updateKerberos(s *System, l string, t time.Time) {
-	targetUserName := getEventData(reTargetUserName, l)
-	targetDomainName := getEventData(reTargetDomainName, l)
-	serviceName := getEventData(reServiceName, l)
-	ipAddress := getEventData(reIPAddress, l)
-	cert := getEventData(reCertIssuerName, l) + ":" + getEventData(reCertSerialNumber, l)
-	status := getKerberosFailCode(getEventData(reStatus, l))
+func updateKerberos(ev *Event, t time.Time) {
+	targetUserName := ev.Get("TargetUserName")
+	targetDomainName := ev.Get("TargetDomainName")
+	serviceName := ev.Get("ServiceName")
+	ipAddress := ev.Get("IpAddress")
+	cert := ev.Get("CertIssuerName") + ":" + ev.Get("CertSerialNumber")
+	status := getKerberosFailCode(ev.Get("Status"))
+	encType := getKerberosEncType(ev.Get("TicketEncryptionType"))
+	options := ev.Get("TicketOptions")
+	preAuth := ev.Get("PreAuthType")
 	ticketType := "TGT"
-	if s.EventID == 4769 {
+	if ev.System.EventID == 4769 {
 		ticketType = "ST"
 	}
 	ts := t.Unix()
 	target := fmt.Sprintf("%s@%s", targetUserName, targetDomainName)
-	id := fmt.Sprintf("%s:%s:%s:%s:%s", target, s.Computer, ipAddress, serviceName, ticketType)
+	id := fmt.Sprintf("%s:%s:%s:%s:%s", target, ev.System.Computer, ipAddress, serviceName, ticketType)
 	if status != "" {
-		msg := fmt.Sprintf("type=KerberosFailed,target=%s,computer=%s,ip=%s,service=%s,ticketType=%s,status=%s,time=%s",
-			target, s.Computer, ipAddress, serviceName, ticketType, status,
-			t.Format(time.RFC3339),
+		f := newSyslogFields("type", "KerberosFailed", "target", target, "computer", ev.System.Computer,
+			"ip", ipAddress, "service", serviceName, "ticketType", ticketType, "status", status,
+			"time", t.Format(time.RFC3339),
 		)
+		msg := f.String()
 		sendSyslog(&syslogEnt{
 			Severity: 4,
 			Time:     t,
 			Msg:      msg,
+			Fields:   f,
 		})
 		publishMQTT(&mqttMessageDataEnt{
 			Time:    t.Format(time.RFC3339),
@@ -108,6 +115,9 @@ func updateKerberos(s *System, l string, t time.Time) {
 			}
 			e.LastStatus = status
 			e.LastCert = cert
+			e.EncType = encType
+			e.Options = options
+			e.PreAuth = preAuth
 			if e.LastTime < ts {
 				e.LastTime = ts
 			}
@@ -117,12 +127,15 @@ func updateKerberos(s *System, l string, t time.Time) {
 	e := &kerberosEnt{
 		Count:      1,
 		Target:     target,
-		Computer:   s.Computer,
+		Computer:   ev.System.Computer,
 		IP:         ipAddress,
 		Service:    serviceName,
 		TicketType: ticketType,
 		LastCert:   cert,
 		LastStatus: status,
+		EncType:    encType,
+		Options:    options,
+		PreAuth:    preAuth,
 		LastTime:   ts,
 		FirstTime:  ts,
 	}
@@ -138,11 +151,11 @@ func sendKerberos() {
 			if debug {
 				log.Printf("kerberosTGT id=%s,e=%v", k, e)
 			}
-			kerberosCount++
+			kerberosCount.Add(1)
 			sendSyslog(&syslogEnt{
 				Severity: 6,
 				Time:     time.Now(),
-				Msg:      e.String(),
+				Fields:   e.Fields(),
 			})
 			publishMQTT(&mqttKerberosDataEnt{
 				Time:       time.Now().Format(time.RFC3339),
@@ -155,6 +168,9 @@ func sendKerberos() {
 				Failed:     e.Failed,
 				LastStatus: e.LastStatus,
 				LastCert:   e.LastCert,
+				EncType:    e.EncType,
+				Options:    e.Options,
+				PreAuth:    e.PreAuth,
 				FirstTime:  time.Unix(e.FirstTime, 0).Format(time.RFC3339),
 				LastTime:   time.Unix(e.LastTime, 0).Format(time.RFC3339),
 			})
@@ -164,6 +180,30 @@ func sendKerberos() {
 	})
 }
 
+// getKerberosEncType : TicketEncryptionTypeの名前
+func getKerberosEncType(c string) string {
+	c = strings.ToLower(strings.TrimSpace(c))
+	switch c {
+	case "":
+		return ""
+	case "0x1":
+		return "DES-CBC-CRC"
+	case "0x3":
+		return "DES-CBC-MD5"
+	case "0x11":
+		return "AES128"
+	case "0x12":
+		return "AES256"
+	case "0x17":
+		return "RC4"
+	case "0x18":
+		return "RC4-EXP"
+	case "0xffffffff":
+		return "Failed"
+	}
+	return "Unknown_" + c
+}
+
 func getKerberosFailCode(c string) string {
 	c = strings.ToLower(strings.TrimSpace(c))
 	switch c {
@@ -1,5 +1,3 @@
-//go:build windows
-
 package main
 
 import (
@@ -10,42 +8,46 @@ import (
 
 // 誰がどのコンピュータにどこからログインしたか？
 
-func checkLogon(s *System, l string, t time.Time) {
-	logonType := getLogonType(getEventData(reLogonType, l))
-	if logonType == "Service" {
-		// Skip Service Logon
-		return
+func checkLogon(ev *Event, t time.Time) {
+	logonType := getLogonType(ev.Get("LogonType"))
+	for _, s := range logonSkipTypes {
+		if logonType == s {
+			// Skip Service Logon
+			return
+		}
 	}
-	subjectUserName := getEventData(reSubjectUserName, l)
-	subjectDomainName := getEventData(reSubjectDomainName, l)
-	targetUserName := getEventData(reTargetUserName, l)
-	targetServerName := getEventData(reTargetServerName, l)
-	targetDomainName := getEventData(reTargetDomainName, l)
-	ipAddress := getEventData(reIPAddress, l)
-	failedCode := getFailedCode(getEventData(reSubStatus, l))
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
+	targetUserName := ev.Get("TargetUserName")
+	targetServerName := ev.Get("TargetServerName")
+	targetDomainName := ev.Get("TargetDomainName")
+	ipAddress := ev.Get("IpAddress")
+	failedCode := getFailedCode(ev.Get("SubStatus"))
 	if targetServerName == "" {
 		if targetDomainName != "" {
 			targetServerName = targetDomainName
 		} else {
-			targetServerName = s.Computer
+			targetServerName = ev.System.Computer
 		}
 	}
 	if strings.Contains(strings.ToLower(targetServerName), "localhost") {
-		targetServerName = s.Computer
+		targetServerName = ev.System.Computer
 	}
 	target := fmt.Sprintf("%s@%s", targetUserName, targetServerName)
 	subject := fmt.Sprintf("%s@%s", subjectUserName, subjectDomainName)
-	switch s.EventID {
+	switch ev.System.EventID {
 	case 4625:
-		logonFailedCount++
-		msg := fmt.Sprintf("type=LogonFailed,subject=%s,target=%s,computer=%s,ip=%s,logonType=%s,failedCode=%s,time=%s",
-			subject, target, s.Computer, ipAddress, logonType, failedCode,
-			t.Format(time.RFC3339),
+		logonFailedCount.Add(1)
+		f := newSyslogFields("type", "LogonFailed", "subject", subject, "target", target, "computer", ev.System.Computer,
+			"ip", ipAddress, "logonType", logonType, "failedCode", failedCode,
+			"time", t.Format(time.RFC3339),
 		)
+		msg := f.String()
 		sendSyslog(&syslogEnt{
 			Severity: 3,
 			Time:     t,
 			Msg:      msg,
+			Fields:   f,
 		})
 		publishMQTT(&mqttMessageDataEnt{
 			Time:    t.Format(time.RFC3339),
@@ -54,15 +56,17 @@ func checkLogon(s *System, l string, t time.Time) {
 			Message: msg,
 		})
 	case 4647, 4634:
-		logoffCount++
-		msg := fmt.Sprintf("type=Logoff,subject=%s,target=%s,computer=%s,ip=%s,logonType=%s,time=%s",
-			subject, target, s.Computer, ipAddress, logonType,
-			t.Format(time.RFC3339),
+		logoffCount.Add(1)
+		f := newSyslogFields("type", "Logoff", "subject", subject, "target", target, "computer", ev.System.Computer,
+			"ip", ipAddress, "logonType", logonType,
+			"time", t.Format(time.RFC3339),
 		)
+		msg := f.String()
 		sendSyslog(&syslogEnt{
 			Severity: 6,
 			Time:     t,
 			Msg:      msg,
+			Fields:   f,
 		})
 		publishMQTT(&mqttMessageDataEnt{
 			Time:    t.Format(time.RFC3339),
@@ -74,15 +78,17 @@ func checkLogon(s *System, l string, t time.Time) {
 		logonType = "Explicit"
 		fallthrough
 	default:
-		logonCount++
-		msg := fmt.Sprintf("type=Logon,subject=%s,target=%s,computer=%s,ip=%s,logonType=%s,time=%s",
-			subject, target, s.Computer, ipAddress, logonType,
-			t.Format(time.RFC3339),
+		logonCount.Add(1)
+		f := newSyslogFields("type", "Logon", "subject", subject, "target", target, "computer", ev.System.Computer,
+			"ip", ipAddress, "logonType", logonType,
+			"time", t.Format(time.RFC3339),
 		)
+		msg := f.String()
 		sendSyslog(&syslogEnt{
 			Severity: 6,
 			Time:     t,
 			Msg:      msg,
+			Fields:   f,
 		})
 		publishMQTT(&mqttMessageDataEnt{
 			Time:    t.Format(time.RFC3339),
@@ -17,6 +17,22 @@ import (
 var version = "v1.1.0"
 var commit = ""
 var syslogDst = ""
+var syslogCA = ""
+var syslogCert = ""
+var syslogKey = ""
+var syslogPin = ""
+var syslogFormat = "bsd"
+var syslogFacility = "local5"
+var syslogSDID = "twwinlog@32473"
+var spoolDir = ""
+var sessionTTL = 24
+var processTTL = 24
+var learnPeriod = 168
+var detectWindow = 600
+var bruteForceThreshold = 10
+var sprayThreshold = 10
+var stBurstThreshold = 10
+var spoolSize = 100
 var mqttDst = ""
 var mqttUser = ""
 var mqttPassword = ""
@@ -27,31 +43,79 @@ var user = ""
 var auth = ""
 var password = ""
 var syslogInterval = 300
+var replay = ""
+var evtxFile = ""
+var stateFile = ""
+var channels = "System;Security;Application"
 var cpuprofile string
 var memprofile string
 var debug bool
 
 func init() {
-	flag.StringVar(&syslogDst, "syslog", "", "syslog destination list")
+	flag.StringVar(&syslogDst, "syslog", "", "syslog destination list(udp|tcp|tls://host:port)")
+	flag.StringVar(&syslogCA, "syslogCA", "", "syslog tls CA certificate file")
+	flag.StringVar(&syslogCert, "syslogCert", "", "syslog tls client certificate file")
+	flag.StringVar(&syslogKey, "syslogKey", "", "syslog tls client key file")
+	flag.StringVar(&syslogPin, "syslogPin", "", "syslog tls server certificate SHA256 fingerprint")
+	flag.StringVar(&syslogFormat, "syslogFormat", "bsd", "syslog format(bsd|rfc5424)")
+	flag.StringVar(&syslogFacility, "syslogFacility", "local5", "syslog facility(name or 0-23)")
+	flag.StringVar(&syslogSDID, "syslogSDID", "twwinlog@32473", "syslog structured data id for rfc5424")
+	flag.StringVar(&spoolDir, "spool", "", "spool directory for unsent messages")
+	flag.IntVar(&sessionTTL, "sessionTTL", 24, "logon session expire time(hour)")
+	flag.IntVar(&processTTL, "processTTL", 24, "process instance expire time(hour)")
+	flag.IntVar(&learnPeriod, "learnPeriod", 168, "learning period of parent/child process baseline(hour)")
+	flag.IntVar(&detectWindow, "detectWindow", 600, "brute force and password spray detect window(sec)")
+	flag.IntVar(&bruteForceThreshold, "bruteForce", 10, "failures of an account to detect brute force(0=disable)")
+	flag.IntVar(&sprayThreshold, "spray", 10, "accounts failed from an ip to detect password spray(0=disable)")
+	flag.IntVar(&stBurstThreshold, "stBurst", 10, "services requested by an account to detect service ticket burst(0=disable)")
+	flag.IntVar(&spoolSize, "spoolSize", 100, "max spool size(MB) per destination")
 	flag.StringVar(&mqttDst, "mqtt", "", "mqtt broker destination")
 	flag.StringVar(&mqttUser, "mqttUser", "", "mqtt user name")
 	flag.StringVar(&mqttPassword, "mqttPassword", "", "mqtt password")
 	flag.StringVar(&mqttClientID, "mqttClientID", "twwinlog", "mqtt client id")
 	flag.StringVar(&mqttTopic, "mqttTopic", "twwinlog", "mqtt topic")
-	flag.StringVar(&remote, "remote", "", "remote windows pc")
+	flag.StringVar(&mqttTopicTemplate, "mqttTopicTemplate", "{topic}/{type}", "mqtt topic template(e.g. {topic}/{sensor}/{computer}/{type}/{event_id})")
+	flag.StringVar(&mqttCA, "mqttCA", "", "mqtt tls CA certificate file")
+	flag.StringVar(&mqttCert, "mqttCert", "", "mqtt tls client certificate file")
+	flag.StringVar(&mqttKey, "mqttKey", "", "mqtt tls client key file")
+	flag.StringVar(&mqttQoS, "mqttQoS", "1", "mqtt qos default and per type(e.g. 1,Alert=2,Monitor=0)")
+	flag.StringVar(&mqttRetain, "mqttRetain", "", "mqtt retained types(e.g. Monitor,Stats)")
+	flag.BoolVar(&mqttCmd, "mqttCmd", false, "accept commands from mqtt <topic>/cmd")
+	flag.StringVar(&remote, "remote", "", "remote windows pc list")
 	flag.StringVar(&user, "user", "", "remote user name")
 	flag.StringVar(&auth, "auth", "", "remote authentication:Default|Negotiate|Kerberos|NTLM")
 	flag.StringVar(&password, "password", "", "remote user's password")
 	flag.IntVar(&syslogInterval, "interval", 300, "syslog send interval(sec)")
+	flag.StringVar(&replay, "replay", "", "replay saved wevtutil xml file or directory")
+	flag.StringVar(&evtxFile, "evtx", "", "read evtx file or directory")
+	flag.StringVar(&stateFile, "state", "", "state file path for bookmarks")
+	flag.StringVar(&channels, "channels", "System;Security;Application", "event log channels(name[=xpath];!disabled)")
+	flag.StringVar(&sigmaDir, "sigma", "", "sigma rule directory")
+	flag.StringVar(&httpAddr, "http", "", "http listen address for metrics and api(e.g. 127.0.0.1:8086)")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to `file`")
 	flag.StringVar(&memprofile, "memprofile", "", "write memory profile to `file`")
 	flag.BoolVar(&debug, "debug", false, "Debug Mode")
+	flag.StringVar(&configFile, "config", "", "config file(yaml)")
+}
+
+// parseFlags : go testでも読み込めるようにinitではなくmainで解析する
+func parseFlags() {
+	flag.Parse()
+	// コマンドライン > 環境変数 > 設定ファイルの順に優先する
+	flag.Visit(func(f *flag.Flag) {
+		flagSet[f.Name] = true
+	})
 	flag.VisitAll(func(f *flag.Flag) {
-		if s := os.Getenv("TWWINLOG_" + strings.ToUpper(f.Name)); s != "" {
+		if s := os.Getenv("TWWINLOG_" + strings.ToUpper(f.Name)); s != "" && !flagSet[f.Name] {
 			f.Value.Set(s)
+			flagSet[f.Name] = true
 		}
 	})
-	flag.Parse()
+	if configFile != "" {
+		if err := loadConfig(configFile); err != nil {
+			log.Fatalf("config err=%v", err)
+		}
+	}
 }
 
 type logWriter struct {
@@ -62,6 +126,7 @@ func (writer logWriter) Write(bytes []byte) (int, error) {
 }
 
 func main() {
+	parseFlags()
 	log.SetFlags(0)
 	log.SetOutput(new(logWriter))
 	if cpuprofile != "" {
@@ -90,14 +155,47 @@ func main() {
 	if syslogDst == "" && mqttDst == "" {
 		log.Fatalln("no syslog or mqtt destination")
 	}
+	if err := checkSyslogParams(); err != nil {
+		log.Fatalf("syslog err=%v", err)
+	}
+	if err := checkMQTTParams(); err != nil {
+		log.Fatalf("mqtt err=%v", err)
+	}
+	if configChannels != nil && !flagSet["channels"] {
+		channelList = configChannels
+	} else if l, err := parseChannels(channels); err != nil {
+		log.Fatalf("channels err=%v", err)
+	} else {
+		channelList = l
+	}
+	if err := loadSigmaRules(); err != nil {
+		log.Fatalf("sigma err=%v", err)
+	}
+	setupRemotes()
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
+	if mqttDst != "" {
+		mqttSpool = newSpool("mqtt")
+	}
+	setupSyslogDst()
 	go startSyslog(ctx)
 	go startMQTT(ctx)
-	go startWinlog(ctx)
-	<-quit
+	go startHTTP(ctx)
+	done := make(chan bool)
+	if isReplay() {
+		go startReplay(ctx, done)
+	} else {
+		go startWinlog(ctx)
+	}
 	msg := "quit by signal"
+	replayDone := false
+	select {
+	case <-quit:
+	case <-done:
+		msg = "replay done"
+		replayDone = true
+	}
 	log.Println(msg)
 	sendSyslog(&syslogEnt{
 		Time:     time.Now(),
@@ -110,6 +208,22 @@ func main() {
 		Type:    "System",
 		Message: msg,
 	})
+	// シグナルで停止する時は送信を待たない
+	if replayDone {
+		waitSend(time.Second * 30)
+	}
 	cancel()
 	time.Sleep(time.Second * 2)
 }
+
+// waitSend : 送信待ちのメッセージがなくなるまで待つ
+func waitSend(timeout time.Duration) {
+	st := time.Now()
+	for getSyslogQueueLen() > 0 || getMQTTQueueLen() > 0 {
+		if time.Since(st) > timeout {
+			log.Printf("waitSend timeout syslog=%d mqtt=%d", getSyslogQueueLen(), getMQTTQueueLen())
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheusのテキスト形式でメトリクスを出力する
+
+var startTime = time.Now()
+
+// handlerCounters : ハンドラーごとに送信したレコード数。集計するハンドラーはイベント数ではない
+var handlerCounters = []struct {
+	Name  string
+	Count *atomic.Int64
+}{
+	{"logon", &logonCount},
+	{"logoff", &logoffCount},
+	{"logonFailed", &logonFailedCount},
+	{"session", &sessionCount},
+	{"process", &processCount},
+	{"processInstance", &processInstanceCount},
+	{"task", &taskCount},
+	{"kerberos", &kerberosCount},
+	{"privilege", &privilegeCount},
+	{"account", &accountCount},
+	{"service", &serviceCount},
+	{"group", &groupCount},
+	{"sigma", &sigmaCount},
+	{"alert", &alertCount},
+}
+
+type metricsWriter struct {
+	b strings.Builder
+}
+
+func (m *metricsWriter) head(name, typ, help string) {
+	fmt.Fprintf(&m.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// add : kvはラベルの名前と値の順に指定する
+func (m *metricsWriter) add(name string, v float64, kv ...string) {
+	m.b.WriteString(name)
+	if len(kv) > 1 {
+		m.b.WriteString("{")
+		for i := 0; i+1 < len(kv); i += 2 {
+			if i > 0 {
+				m.b.WriteString(",")
+			}
+			fmt.Fprintf(&m.b, "%s=\"%s\"", kv[i], escapeMetricsLabel(kv[i+1]))
+		}
+		m.b.WriteString("}")
+	}
+	m.b.WriteString(" ")
+	m.b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	m.b.WriteString("\n")
+}
+
+func escapeMetricsLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(getMetrics()))
+}
+
+func getMetrics() string {
+	m := &metricsWriter{}
+	m.head("twwinlog_info", "gauge", "Version of twwinlog.")
+	m.add("twwinlog_info", 1, "version", version, "commit", commit)
+	m.head("twwinlog_start_time_seconds", "gauge", "Start time of twwinlog in unix time.")
+	m.add("twwinlog_start_time_seconds", float64(startTime.Unix()))
+
+	// イベントの集計はイベントの処理と同時に変更しない
+	eventMu.Lock()
+	events := []*EventIDEnt{}
+	eventIDMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*EventIDEnt); ok {
+			c := *e
+			events = append(events, &c)
+		}
+		return true
+	})
+	lastEvent := lastEventTime
+	eventMu.Unlock()
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Channel != events[j].Channel {
+			return events[i].Channel < events[j].Channel
+		}
+		if events[i].EventID != events[j].EventID {
+			return events[i].EventID < events[j].EventID
+		}
+		return events[i].Computer < events[j].Computer
+	})
+	m.head("twwinlog_events_total", "counter", "Events read by computer, channel, provider and event ID.")
+	for _, e := range events {
+		m.add("twwinlog_events_total", float64(e.Total), "computer", e.Computer, "channel", e.Channel,
+			"provider", e.Provider, "event_id", strconv.Itoa(e.EventID))
+	}
+	m.head("twwinlog_last_event_timestamp_seconds", "gauge", "Time of the last event in unix time.")
+	m.add("twwinlog_last_event_timestamp_seconds", float64(lastEvent))
+
+	m.head("twwinlog_handler_records_total", "counter", "Records sent by handler.")
+	for _, h := range handlerCounters {
+		m.add("twwinlog_handler_records_total", float64(h.Count.Load()), "handler", h.Name)
+	}
+
+	m.head("twwinlog_poll_duration_seconds", "gauge", "Duration of the last event log poll.")
+	for _, rm := range remoteList {
+		m.add("twwinlog_poll_duration_seconds", time.Duration(rm.pollDuration.Load()).Seconds(), "remote", rm.key())
+	}
+	m.head("twwinlog_last_poll_timestamp_seconds", "gauge", "Time of the last event log poll in unix time.")
+	for _, rm := range remoteList {
+		m.add("twwinlog_last_poll_timestamp_seconds", float64(rm.pollTime.Load()), "remote", rm.key())
+	}
+	m.head("twwinlog_poll_events_total", "counter", "Events read by remote.")
+	for _, rm := range remoteList {
+		m.add("twwinlog_poll_events_total", float64(rm.pollEvents.Load()), "remote", rm.key())
+	}
+
+	m.head("twwinlog_syslog_messages_total", "counter", "Syslog messages sent to the destinations.")
+	m.add("twwinlog_syslog_messages_total", float64(syslogCount.Load()))
+	sinks := getSyslogDstStats()
+	m.head("twwinlog_sink_up", "gauge", "Whether the destination is connected.")
+	for _, s := range sinks {
+		m.add("twwinlog_sink_up", boolMetric(s.Healthy), "sink", "syslog", "dst", s.Dst)
+	}
+	if mqttDst != "" {
+		m.add("twwinlog_sink_up", boolMetric(mqttConnected.Load()), "sink", "mqtt", "dst", mqttDst)
+	}
+	m.head("twwinlog_sink_sent_total", "counter", "Messages sent by destination.")
+	for _, s := range sinks {
+		m.add("twwinlog_sink_sent_total", float64(s.Sent), "sink", "syslog", "dst", s.Dst)
+	}
+	m.head("twwinlog_sink_dropped_total", "counter", "Messages dropped by destination.")
+	for _, s := range sinks {
+		m.add("twwinlog_sink_dropped_total", float64(s.Dropped), "sink", "syslog", "dst", s.Dst)
+	}
+	m.head("twwinlog_sink_queue_length", "gauge", "Messages waiting to be sent including the spool.")
+	m.add("twwinlog_sink_queue_length", float64(len(syslogCh)), "sink", "syslog", "dst", "")
+	for _, s := range sinks {
+		m.add("twwinlog_sink_queue_length", float64(s.Queue), "sink", "syslog", "dst", s.Dst)
+	}
+	if mqttDst != "" {
+		m.add("twwinlog_sink_queue_length", float64(getMQTTQueueLen()), "sink", "mqtt", "dst", mqttDst)
+	}
+
+	spooled, queued, dropped := getSpoolStats()
+	m.head("twwinlog_spooled_total", "counter", "Messages saved to the spool.")
+	m.add("twwinlog_spooled_total", float64(spooled))
+	m.head("twwinlog_spool_length", "gauge", "Messages remaining in the spool.")
+	m.add("twwinlog_spool_length", float64(queued))
+	m.head("twwinlog_dropped_total", "counter", "Messages dropped without sending.")
+	m.add("twwinlog_dropped_total", float64(dropped))
+	return m.b.String()
+}
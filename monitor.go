@@ -18,25 +18,25 @@ var lastBytesSent uint64
 
 // sendMonitor : センサーが稼働するPCのリソース情報を送信する
 func sendMonitor(param string) {
-	msg := "type=Monitor,"
+	f := newSyslogFields("type", "Monitor")
 	cpus, err := cpu.Percent(0, false)
 	if err != nil {
 		log.Printf("sendMonitor err=%v", err)
 		return
 	}
-	msg += fmt.Sprintf("cpu=%.3f", cpus[0])
+	f = append(f, newSyslogFields("cpu", fmt.Sprintf("%.3f", cpus[0]))...)
 	loads, err := load.Avg()
 	if err != nil {
 		log.Printf("sendMonitor err=%v", err)
 		return
 	}
-	msg += fmt.Sprintf(",load=%.3f", loads.Load1)
+	f = append(f, newSyslogFields("load", fmt.Sprintf("%.3f", loads.Load1))...)
 	mems, err := mem.VirtualMemory()
 	if err != nil {
 		log.Printf("sendMonitor err=%v", err)
 		return
 	}
-	msg += fmt.Sprintf(",mem=%.3f", mems.UsedPercent)
+	f = append(f, newSyslogFields("mem", fmt.Sprintf("%.3f", mems.UsedPercent))...)
 	nets, err := gopsnet.IOCounters(false)
 	if err != nil {
 		log.Printf("sendMonitor err=%v", err)
@@ -58,8 +58,8 @@ func sendMonitor(param string) {
 			rxSpeed /= (1000 * 1000)
 			txSpeed := 8.0 * float64(dSent) / float64(diff)
 			txSpeed /= (1000 * 1000)
-			msg += fmt.Sprintf(",recv=%d,sent=%d,rxSpeed=%.3f,txSpeed=%.3f",
-				dRecv, dSent, rxSpeed, txSpeed)
+			f = append(f, newSyslogFields("recv", dRecv, "sent", dSent,
+				"rxSpeed", fmt.Sprintf("%.3f", rxSpeed), "txSpeed", fmt.Sprintf("%.3f", txSpeed))...)
 			mqttData.Sent = dSent
 			mqttData.Recv = dRecv
 			mqttData.TxSpeed = txSpeed
@@ -74,12 +74,12 @@ func sendMonitor(param string) {
 		log.Printf("sendMonitor err=%v", err)
 		return
 	}
-	msg += fmt.Sprintf(",process=%d,param=%s", len(pids), param)
+	f = append(f, newSyslogFields("process", len(pids), "param", param)...)
 	mqttData.Process = len(pids)
 	sendSyslog(&syslogEnt{
 		Time:     time.Now(),
 		Severity: 6,
-		Msg:      msg,
+		Fields:   f,
 	})
 	publishMQTT(mqttData)
 }
@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -12,6 +20,51 @@ import (
 
 var mqttCh = make(chan interface{}, 2000)
 
+// mqttStopped : 送信ループが終了したらcloseする
+var mqttStopped = make(chan struct{})
+
+// mqttPending : スプールする時にmqttChがいっぱいで渡せなかったメッセージ
+// 空になるまではmqttChに送らないのでmqttChのメッセージより後になる
+var mqttPending []interface{}
+var mqttPendingMu sync.Mutex
+var mqttPendingCh = make(chan struct{}, 1)
+
+// mqttPendingMax : 送信ループが止まっている時にメモリーに保持する数。リプレイ中は捨てない
+const mqttPendingMax = 100000
+
+// mqttConnected : ブローカーとの接続状態
+var mqttConnected atomic.Bool
+
+// mqttSpool : ブローカーに接続できない間のメッセージを保存する
+var mqttSpool *spoolEnt
+
+// mqttSpoolDataEnt : スプールに保存するメッセージ
+type mqttSpoolDataEnt struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+var mqttCA = ""
+var mqttCert = ""
+var mqttKey = ""
+var mqttQoS = "1"
+var mqttRetain = ""
+
+// mqttTLSConfig : checkMQTTParamsで作成したTLSの設定
+var mqttTLSConfig *tls.Config
+
+// mqttQoSMap : 種類ごとのQoS。""はデフォルト
+var mqttQoSMap = map[string]byte{"": 1}
+var mqttRetainMap = map[string]bool{}
+
+// mqttTypeNames : QoSとretainを指定できる種類
+var mqttTypeNames = []string{
+	"EventID", "Account", "Kerberos", "Privilege", "Process", "ProcessInstance", "Task", "Group", "Service",
+	"Session", "Sigma", "Alert", "Stats", "Message", "Monitor", "cmd/result",
+}
+
 type mqttAccountDataEnt struct {
 	Time      string `json:"time"`
 	Target    string `json:"target"`
@@ -49,6 +102,9 @@ type mqttKerberosDataEnt struct {
 	Failed     int    `json:"failed"`
 	LastStatus string `json:"last_status"`
 	LastCert   string `json:"last_cert"`
+	EncType    string `json:"enc_type"`
+	Options    string `json:"ticket_options"`
+	PreAuth    string `json:"pre_auth_type"`
 	FirstTime  string `json:"first_time"`
 	LastTime   string `json:"last_time"`
 }
@@ -77,23 +133,112 @@ type mqttProcessDataEnt struct {
 	SendTime    int64  `json:"send_time"`
 }
 
+type mqttProcessInstanceDataEnt struct {
+	Time        string `json:"time"`
+	Computer    string `json:"computer"`
+	PID         string `json:"pid"`
+	PPID        string `json:"ppid"`
+	Process     string `json:"process"`
+	CommandLine string `json:"command_line"`
+	Chain       string `json:"chain"`
+	Subject     string `json:"subject"`
+	Elevation   string `json:"elevation"`
+	Integrity   string `json:"integrity"`
+	State       string `json:"state"`
+	Status      string `json:"status"`
+	Duration    int64  `json:"duration"`
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+}
+
 type mqttTaskDataEnt struct {
 	Time      string `json:"time"`
+	Action    string `json:"action"`
 	Subject   string `json:"subject"`
 	Computer  string `json:"computer"`
 	TaskName  string `json:"task_name"`
+	Command   string `json:"command"`
+	Arguments string `json:"arguments"`
+	Triggers  string `json:"triggers"`
+	RunAs     string `json:"run_as"`
 	Count     int    `json:"count"`
 	FirstTime string `json:"first_time"`
 	LastTime  string `json:"last_time"`
 	SendTime  int64  `json:"send_time"`
 }
 
+type mqttGroupDataEnt struct {
+	Time      string `json:"time"`
+	Action    string `json:"action"`
+	Subject   string `json:"subject"`
+	Member    string `json:"member"`
+	Group     string `json:"group"`
+	Scope     string `json:"scope"`
+	Computer  string `json:"computer"`
+	Count     int    `json:"count"`
+	FirstTime string `json:"first_time"`
+	LastTime  string `json:"last_time"`
+}
+
+type mqttServiceDataEnt struct {
+	Time        string `json:"time"`
+	Computer    string `json:"computer"`
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	ServiceType string `json:"service_type"`
+	StartType   string `json:"start_type"`
+	Account     string `json:"account"`
+	Subject     string `json:"subject"`
+	Count       int    `json:"count"`
+	FirstTime   string `json:"first_time"`
+	LastTime    string `json:"last_time"`
+}
+
+type mqttSessionDataEnt struct {
+	Time      string `json:"time"`
+	Target    string `json:"target"`
+	Computer  string `json:"computer"`
+	LogonID   string `json:"logon_id"`
+	IP        string `json:"ip"`
+	LogonType string `json:"logon_type"`
+	Elevated  bool   `json:"elevated"`
+	Status    string `json:"status"`
+	Duration  int64  `json:"duration"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+type mqttSigmaDataEnt struct {
+	Time     string            `json:"time"`
+	ID       string            `json:"id"`
+	Title    string            `json:"title"`
+	Level    string            `json:"level"`
+	Computer string            `json:"computer"`
+	Channel  string            `json:"channel"`
+	EventID  int               `json:"event_id"`
+	RecordID int64             `json:"record_id"`
+	Tags     []string          `json:"tags"`
+	Fields   map[string]string `json:"fields"`
+}
+
+type mqttAlertDataEnt struct {
+	Time     string            `json:"time"`
+	Level    string            `json:"level"`
+	Alert    string            `json:"alert"`
+	Computer string            `json:"computer"`
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields"`
+}
+
 type mqttStatsDataEnt struct {
-	Time   string  `json:"time"`
-	Total  int     `json:"total"`
-	Count  int     `json:"count"`
-	PS     float64 `json:"ps"`
-	Params string  `json:"params"`
+	Time    string  `json:"time"`
+	Total   int     `json:"total"`
+	Count   int     `json:"count"`
+	PS      float64 `json:"ps"`
+	Params  string  `json:"params"`
+	Spooled int64   `json:"spooled"`
+	Queued  int64   `json:"queued"`
+	Dropped int64   `json:"dropped"`
 }
 
 type mqttMessageDataEnt struct {
@@ -119,16 +264,20 @@ func startMQTT(ctx context.Context) {
 	if mqttDst == "" {
 		return
 	}
-	broker := mqttDst
-	if !strings.Contains(broker, "://") {
-		broker = "tcp://" + broker
-	}
-	if strings.LastIndex(broker, ":") <= 5 {
-		broker += ":1883"
+	defer close(mqttStopped)
+	broker, err := getMQTTBroker()
+	if err != nil {
+		log.Printf("mqtt err=%v", err)
+		return
 	}
 	log.Printf("start mqtt broker=%s", broker)
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
+	if mqttTLSConfig != nil {
+		opts.SetTLSConfig(mqttTLSConfig)
+	}
+	// 異常終了した時はブローカーがofflineにする
+	opts.SetWill(getMQTTStatusTopic(), "offline", 1, true)
 	if mqttUser != "" && mqttPassword != "" {
 		opts.SetUsername(mqttUser)
 		opts.SetPassword(mqttPassword)
@@ -141,68 +290,366 @@ func startMQTT(ctx context.Context) {
 	opts.SetWriteTimeout(time.Second * 10)
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
 		log.Println("mqtt connected")
+		mqttConnected.Store(true)
+		c.Publish(getMQTTStatusTopic(), 1, true, "online")
+		subscribeMQTTCmd(ctx, c)
 	})
 	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
 		log.Printf("mqtt connection lost: %v", err)
+		mqttConnected.Store(false)
 	})
 
 	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	// ブローカーが停止していても接続を待たずに送信ループを始める
+	if token := client.Connect(); token.WaitTimeout(time.Second*5) && token.Error() != nil {
 		log.Printf("mqtt initial connect error: %v (will retry in background)", token.Error())
 	}
 
 	defer client.Disconnect(250)
+	timer := time.NewTicker(time.Second)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("stop mqtt")
+			saveMQTTSpool()
+			if client.IsConnectionOpen() {
+				client.Publish(getMQTTStatusTopic(), 1, true, "offline").WaitTimeout(time.Second)
+			}
 			return
+		case <-timer.C:
+			if client.IsConnectionOpen() {
+				sendMQTTSpool(client)
+			}
 		case msg := <-mqttCh:
-			if s := makeMqttData(msg); s != "" {
-				if debug {
-					log.Println(s)
-				}
-				if client.IsConnected() {
-					token := client.Publish(getMqttTopic(msg), 1, false, s)
-					go func(t mqtt.Token) {
-						if t.Wait() && t.Error() != nil {
-							// Only log error if not connected or it's not a common transient error
-							if client.IsConnected() {
-								log.Printf("mqtt publish error: %v", t.Error())
-							}
-						}
-					}(token)
+			sendMQTT(client, msg)
+			if len(mqttCh) == 0 {
+				for _, msg := range takeMQTTPending() {
+					sendMQTT(client, msg)
 				}
 			}
+		case <-mqttPendingCh:
+			for _, msg := range takeMQTTPending() {
+				sendMQTT(client, msg)
+			}
+		}
+	}
+}
+
+func sendMQTT(client mqtt.Client, msg interface{}) {
+	s := makeMqttData(msg)
+	if s == "" {
+		return
+	}
+	if debug {
+		log.Println(s)
+	}
+	// 接続できない間とスプールに残っている間はスプールに追加する
+	if mqttSpool != nil && (!client.IsConnectionOpen() || mqttSpool.Len() > 0) {
+		pushMQTTSpool(msg, s)
+		return
+	}
+	if !client.IsConnectionOpen() {
+		sendDropped.Add(1)
+		return
+	}
+	qos, retain := getMQTTQoS(getMqttType(msg))
+	token := client.Publish(getMqttTopic(msg), qos, retain, s)
+	go func(t mqtt.Token) {
+		if t.Wait() && t.Error() != nil {
+			// Only log error if not connected or it's not a common transient error
+			if client.IsConnectionOpen() {
+				log.Printf("mqtt publish error: %v", t.Error())
+			}
 		}
+	}(token)
+}
+
+// takeMQTTPending : mqttChのメッセージを送信した後で保持したメッセージを取り出す
+func takeMQTTPending() []interface{} {
+	mqttPendingMu.Lock()
+	defer mqttPendingMu.Unlock()
+	if len(mqttCh) > 0 {
+		return nil
 	}
+	l := mqttPending
+	mqttPending = nil
+	return l
 }
 
 func getMqttTopic(msg interface{}) string {
-	r := mqttTopic
+	t := getMqttType(msg)
+	if t == "" {
+		log.Printf("getMqttTopic: unknown msg type %T", msg)
+		return mqttTopic
+	}
+	if t == "cmd/result" {
+		// コマンドの結果はテンプレートに関係なく固定のトピック
+		return mqttTopic + "/" + t
+	}
+	r := ""
+	for _, p := range mqttTopicParts {
+		switch p.Field {
+		case "":
+			r += p.Text
+		case "topic":
+			r += mqttTopic
+		case "sensor":
+			r += mqttClientID
+		case "type":
+			r += t
+		default:
+			r += getMqttTopicField(msg, p.Field)
+		}
+	}
+	return r
+}
+
+// mqttTopicPartEnt : トピックのテンプレートを分解したもの。Fieldが空の時は固定の文字列
+type mqttTopicPartEnt struct {
+	Text  string
+	Field string
+}
+
+var mqttTopicTemplate = "{topic}/{type}"
+var mqttTopicParts = []mqttTopicPartEnt{{Field: "topic"}, {Text: "/"}, {Field: "type"}}
+
+// mqttDataEnts : テンプレートで使えるフィールドを調べるためのメッセージ
+var mqttDataEnts = []interface{}{
+	&mqttEventIDDataEnt{}, &mqttAccountDataEnt{}, &mqttKerberosDataEnt{}, &mqttPrivilegeDataEnt{},
+	&mqttProcessDataEnt{}, &mqttProcessInstanceDataEnt{}, &mqttTaskDataEnt{}, &mqttGroupDataEnt{},
+	&mqttServiceDataEnt{}, &mqttSessionDataEnt{}, &mqttSigmaDataEnt{}, &mqttAlertDataEnt{},
+	&mqttStatsDataEnt{}, &mqttMessageDataEnt{}, &mqttMonitorDataEnt{},
+}
+
+// parseMQTTTopicTemplate : twwinlog/{sensor}/{computer}/{type}/{event_id}の形式
+// {topic},{sensor},{type}とメッセージのJSONのフィールド名が使える
+func parseMQTTTopicTemplate(s string) ([]mqttTopicPartEnt, error) {
+	ret := []mqttTopicPartEnt{}
+	tmpl := s
+	for s != "" {
+		i := strings.Index(s, "{")
+		if i < 0 {
+			ret = append(ret, mqttTopicPartEnt{Text: s})
+			break
+		}
+		if i > 0 {
+			ret = append(ret, mqttTopicPartEnt{Text: s[:i]})
+		}
+		j := strings.Index(s[i:], "}")
+		if j < 0 {
+			return nil, fmt.Errorf("topic template: missing } in %s", tmpl)
+		}
+		f := s[i+1 : i+j]
+		if !isMqttTopicField(f) {
+			return nil, fmt.Errorf("topic template: unknown field {%s}", f)
+		}
+		ret = append(ret, mqttTopicPartEnt{Field: f})
+		s = s[i+j+1:]
+	}
+	for _, p := range ret {
+		if strings.ContainsAny(p.Text, "+#{}") {
+			return nil, fmt.Errorf("topic template: invalid char in %s", p.Text)
+		}
+	}
+	return ret, nil
+}
+
+func isMqttTopicField(f string) bool {
+	switch f {
+	case "topic", "sensor", "type":
+		return true
+	case "":
+		return false
+	}
+	for _, m := range mqttDataEnts {
+		t := reflect.TypeOf(m).Elem()
+		for i := 0; i < t.NumField(); i++ {
+			if getJSONName(t.Field(i)) == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getMqttTopicField : メッセージのフィールドの値をトピックに使える文字列にする
+// フィールドがないか空の時は-にする
+func getMqttTopicField(msg interface{}, f string) string {
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return "-"
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if getJSONName(v.Type().Field(i)) != f {
+			continue
+		}
+		s := fmt.Sprintf("%v", v.Field(i).Interface())
+		if s == "" {
+			return "-"
+		}
+		return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+	}
+	return "-"
+}
+
+func getJSONName(f reflect.StructField) string {
+	n, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return n
+}
+
+// getMqttType : トピックとQoS/retainの設定に使うメッセージの種類
+func getMqttType(msg interface{}) string {
 	switch msg.(type) {
 	case *mqttEventIDDataEnt:
-		r += "/EventID"
+		return "EventID"
 	case *mqttAccountDataEnt:
-		r += "/Account"
+		return "Account"
 	case *mqttKerberosDataEnt:
-		r += "/Kerberos"
+		return "Kerberos"
 	case *mqttPrivilegeDataEnt:
-		r += "/Privilege"
+		return "Privilege"
 	case *mqttProcessDataEnt:
-		r += "/Process"
+		return "Process"
+	case *mqttProcessInstanceDataEnt:
+		return "ProcessInstance"
 	case *mqttTaskDataEnt:
-		r += "/Task"
+		return "Task"
+	case *mqttGroupDataEnt:
+		return "Group"
+	case *mqttServiceDataEnt:
+		return "Service"
+	case *mqttSessionDataEnt:
+		return "Session"
+	case *mqttCmdResultDataEnt:
+		return "cmd/result"
+	case *mqttSigmaDataEnt:
+		return "Sigma"
+	case *mqttAlertDataEnt:
+		return "Alert"
 	case *mqttStatsDataEnt:
-		r += "/Stats"
+		return "Stats"
 	case *mqttMessageDataEnt:
-		r += "/Message"
+		return "Message"
 	case *mqttMonitorDataEnt:
-		r += "/Monitor"
+		return "Monitor"
+	}
+	return ""
+}
+
+// getMQTTStatusTopic : LWTとonlineを送信するトピック
+func getMQTTStatusTopic() string {
+	return mqttTopic + "/status"
+}
+
+// getMQTTBroker : スキームがない時はtcp://、ポートがない時はスキームの標準のポートにする
+func getMQTTBroker() (string, error) {
+	broker := mqttDst
+	if !strings.Contains(broker, "://") {
+		broker = "tcp://" + broker
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", err
+	}
+	port := ""
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		port = "1883"
+	case "ssl", "tls", "mqtts", "tcps":
+		port = "8883"
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
 	default:
-		log.Printf("getMqttTopic: unknown msg type %T", msg)
+		return "", fmt.Errorf("unknown scheme %s", u.Scheme)
 	}
-	return r
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.String(), nil
+}
+
+func isMQTTTLS(broker string) bool {
+	for _, s := range []string{"ssl://", "tls://", "mqtts://", "tcps://", "wss://"} {
+		if strings.HasPrefix(broker, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMQTTParams : -mqttQoSは1,Alert=2,Monitor=0、-mqttRetainはMonitor,Statsの形式
+func checkMQTTParams() error {
+	if mqttDst == "" {
+		return nil
+	}
+	broker, err := getMQTTBroker()
+	if err != nil {
+		return err
+	}
+	var tlsConf *tls.Config
+	if isMQTTTLS(broker) || mqttCA != "" || mqttCert != "" || mqttKey != "" {
+		if tlsConf, err = newTLSConfig(mqttCA, mqttCert, mqttKey, ""); err != nil {
+			return fmt.Errorf("tls %v", err)
+		}
+	}
+	checkType := func(t string) error {
+		for _, n := range mqttTypeNames {
+			if n == t {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown type %s (%s)", t, strings.Join(mqttTypeNames, ","))
+	}
+	qos := map[string]byte{"": 1}
+	for _, e := range strings.Split(mqttQoS, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		k, v := "", e
+		if i := strings.Index(e, "="); i >= 0 {
+			k, v = strings.TrimSpace(e[:i]), strings.TrimSpace(e[i+1:])
+			if err := checkType(k); err != nil {
+				return fmt.Errorf("qos: %v", err)
+			}
+		}
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 0 || q > 2 {
+			return fmt.Errorf("qos: %s must be 0-2", e)
+		}
+		qos[k] = byte(q)
+	}
+	retain := make(map[string]bool)
+	for _, t := range strings.Split(mqttRetain, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if err := checkType(t); err != nil {
+			return fmt.Errorf("retain: %v", err)
+		}
+		retain[t] = true
+	}
+	parts, err := parseMQTTTopicTemplate(mqttTopicTemplate)
+	if err != nil {
+		return err
+	}
+	mqttQoSMap = qos
+	mqttRetainMap = retain
+	mqttTopicParts = parts
+	mqttTLSConfig = tlsConf
+	return nil
+}
+
+// getMQTTQoS : 種類ごとのQoSとretain
+func getMQTTQoS(t string) (byte, bool) {
+	q, ok := mqttQoSMap[t]
+	if !ok {
+		q = mqttQoSMap[""]
+	}
+	return q, mqttRetainMap[t]
 }
 
 func makeMqttData(msg interface{}) string {
@@ -213,14 +660,97 @@ func makeMqttData(msg interface{}) string {
 }
 
 func publishMQTT(msg interface{}) {
-	if mqttDst == "" {
+	if mqttDst == "" || !filterMQTT(msg) {
 		return
 	}
-	select {
-	case mqttCh <- msg:
-	default:
-		if debug {
-			log.Println("mqtt channel full, skipping message")
+	mqttPendingMu.Lock()
+	if len(mqttPending) < 1 {
+		select {
+		case mqttCh <- msg:
+			mqttPendingMu.Unlock()
+			return
+		default:
+		}
+	}
+	if mqttSpool != nil && (len(mqttPending) < mqttPendingMax || isReplay()) {
+		// 送信ループがスプールの再送中でも待たずに順番を守って渡す
+		mqttPending = append(mqttPending, msg)
+		mqttPendingMu.Unlock()
+		select {
+		case mqttPendingCh <- struct{}{}:
+		default:
+		}
+		return
+	}
+	mqttPendingMu.Unlock()
+	if mqttSpool == nil && isReplay() {
+		// リプレイ中は捨てずに送信を待つが、送信ループが止まっている時は待ち続けない
+		select {
+		case mqttCh <- msg:
+			return
+		case <-mqttStopped:
+		case <-time.After(replaySendTimeout):
+			log.Println("mqtt channel send timeout")
 		}
 	}
+	sendDropped.Add(1)
+	if debug {
+		log.Println("mqtt channel full, skipping message")
+	}
+}
+
+func pushMQTTSpool(msg interface{}, payload string) {
+	qos, retain := getMQTTQoS(getMqttType(msg))
+	e := &mqttSpoolDataEnt{Topic: getMqttTopic(msg), Payload: payload, QoS: qos, Retain: retain}
+	if j, err := json.Marshal(e); err == nil {
+		mqttSpool.Push(string(j))
+	}
+}
+
+// sendMQTTSpool : 再接続した後にスプールしたメッセージを順番に送信する
+func sendMQTTSpool(client mqtt.Client) {
+	for i := 0; i < 1000; i++ {
+		s, ok := mqttSpool.Peek()
+		if !ok {
+			return
+		}
+		var e mqttSpoolDataEnt
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			log.Printf("mqtt spool err=%v", err)
+			mqttSpool.Pop()
+			continue
+		}
+		t := client.Publish(e.Topic, e.QoS, e.Retain, e.Payload)
+		if !t.WaitTimeout(time.Second*10) || t.Error() != nil {
+			log.Printf("mqtt spool publish err=%v", t.Error())
+			return
+		}
+		mqttSpool.Pop()
+	}
+}
+
+// saveMQTTSpool : 停止する時に送信待ちのメッセージをスプールに保存する
+func saveMQTTSpool() {
+	if mqttSpool == nil {
+		return
+	}
+	for len(mqttCh) > 0 {
+		msg := <-mqttCh
+		if s := makeMqttData(msg); s != "" {
+			pushMQTTSpool(msg, s)
+		}
+	}
+	for _, msg := range takeMQTTPending() {
+		if s := makeMqttData(msg); s != "" {
+			pushMQTTSpool(msg, s)
+		}
+	}
+}
+
+// getMQTTQueueLen : 送信待ちのメッセージ数
+func getMQTTQueueLen() int {
+	mqttPendingMu.Lock()
+	n := len(mqttPending)
+	mqttPendingMu.Unlock()
+	return len(mqttCh) + n + mqttSpool.Len()
 }
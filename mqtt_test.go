@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 証明書を読み込めない時は起動時にエラーにすること
+func TestCheckMQTTParamsTLS(t *testing.T) {
+	defer func() {
+		mqttDst = ""
+		mqttCA = ""
+		mqttTLSConfig = nil
+	}()
+	tests := []struct {
+		dst   string
+		ca    string
+		ok    bool
+		isTLS bool
+	}{
+		{"127.0.0.1", "", true, false},
+		{"tls://127.0.0.1", "", true, true},
+		{"tls://127.0.0.1", "/nonexist/ca.pem", false, false},
+		{"tcp://127.0.0.1", "/nonexist/ca.pem", false, false},
+	}
+	for _, tt := range tests {
+		mqttDst = tt.dst
+		mqttCA = tt.ca
+		mqttTLSConfig = nil
+		err := checkMQTTParams()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s ca=%s err=%v", tt.dst, tt.ca, err)
+		}
+		if (mqttTLSConfig != nil) != tt.isTLS {
+			t.Errorf("%s ca=%s tls=%v", tt.dst, tt.ca, mqttTLSConfig != nil)
+		}
+	}
+}
+
+// mqttChがいっぱいでもスプールする時は待たずに順番を守って渡すこと
+func TestPublishMQTTPending(t *testing.T) {
+	mqttDst = "127.0.0.1"
+	mqttSpool = &spoolEnt{Name: "test"}
+	defer func() {
+		mqttDst = ""
+		mqttSpool = nil
+		mqttPending = nil
+	}()
+	n := cap(mqttCh) + 100
+	for i := 0; i < n; i++ {
+		publishMQTT(&mqttMessageDataEnt{Message: fmt.Sprint(i)})
+	}
+	if l := getMQTTQueueLen(); l != n {
+		t.Errorf("queue=%d want %d", l, n)
+	}
+	if l := takeMQTTPending(); l != nil {
+		t.Errorf("pending taken before mqttCh is empty len=%d", len(l))
+	}
+	got := []string{}
+	for len(mqttCh) > 0 {
+		got = append(got, (<-mqttCh).(*mqttMessageDataEnt).Message)
+	}
+	for _, msg := range takeMQTTPending() {
+		got = append(got, msg.(*mqttMessageDataEnt).Message)
+	}
+	if len(got) != n {
+		t.Fatalf("got=%d want %d", len(got), n)
+	}
+	for i, m := range got {
+		if m != fmt.Sprint(i) {
+			t.Fatalf("order %d=%s", i, m)
+		}
+	}
+}
+
+func TestParseMQTTTopicTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want []mqttTopicPartEnt
+		ok   bool
+	}{
+		{"{topic}/{type}", []mqttTopicPartEnt{{Field: "topic"}, {Text: "/"}, {Field: "type"}}, true},
+		{"site1/{sensor}/{computer}/{type}/{event_id}", []mqttTopicPartEnt{
+			{Text: "site1/"}, {Field: "sensor"}, {Text: "/"}, {Field: "computer"}, {Text: "/"},
+			{Field: "type"}, {Text: "/"}, {Field: "event_id"},
+		}, true},
+		{"{topic}-{level}", []mqttTopicPartEnt{{Field: "topic"}, {Text: "-"}, {Field: "level"}}, true},
+		{"fixed", []mqttTopicPartEnt{{Text: "fixed"}}, true},
+		{"{topic}/{unknown}", nil, false},
+		{"{topic}/{Computer}", nil, false},
+		{"{topic}/{}", nil, false},
+		{"{topic}/{type", nil, false},
+		{"{topic}/type}", nil, false},
+		{"{topic}/+/{type}", nil, false},
+		{"{topic}/#", nil, false},
+	}
+	for _, tt := range tests {
+		l, err := parseMQTTTopicTemplate(tt.tmpl)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s err=%v", tt.tmpl, err)
+			continue
+		}
+		if len(l) != len(tt.want) {
+			t.Errorf("%s=%v want %v", tt.tmpl, l, tt.want)
+			continue
+		}
+		for i := range l {
+			if l[i] != tt.want[i] {
+				t.Errorf("%s=%v want %v", tt.tmpl, l, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestGetMqttTopic(t *testing.T) {
+	defer func() {
+		mqttTopic = "twwinlog"
+		mqttClientID = "twwinlog"
+		mqttTopicParts, _ = parseMQTTTopicTemplate("{topic}/{type}")
+	}()
+	mqttTopic = "tw"
+	mqttClientID = "sensor1"
+	parts, err := parseMQTTTopicTemplate("{topic}/{sensor}/{computer}/{type}/{event_id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mqttTopicParts = parts
+	tests := []struct {
+		name string
+		msg  interface{}
+		want string
+	}{
+		{"fields", &mqttEventIDDataEnt{Computer: "DC01", EventID: 4624}, "tw/sensor1/DC01/EventID/4624"},
+		{"empty value", &mqttEventIDDataEnt{EventID: 7045}, "tw/sensor1/-/EventID/7045"},
+		{"sanitize", &mqttEventIDDataEnt{Computer: "a/b+c#d", EventID: 1}, "tw/sensor1/a_b_c_d/EventID/1"},
+		{"no field", &mqttAlertDataEnt{Computer: "DC01"}, "tw/sensor1/DC01/Alert/-"},
+		{"sigma", &mqttSigmaDataEnt{Computer: "PC01", EventID: 1}, "tw/sensor1/PC01/Sigma/1"},
+		{"cmd result", &mqttCmdResultDataEnt{}, "tw/cmd/result"},
+	}
+	for _, tt := range tests {
+		if got := getMqttTopic(tt.msg); got != tt.want {
+			t.Errorf("%s=%s want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,9 +2,18 @@
 
 package main
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // startWinlog : start monitor windows event log
 func startWinlog(_ context.Context) {
 	sendMonitor("dumy")
 }
+
+// requeryWinlog : Windows以外では読み直せない
+func requeryWinlog(_ context.Context, _, _ string, _, _ time.Time) (int, error) {
+	return 0, fmt.Errorf("requery is not supported on this platform")
+}
@@ -1,10 +1,9 @@
-//go:build windows
-
 package main
 
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,23 +16,23 @@ type privilegeEnt struct {
 	LastTime  int64
 }
 
-func (e *privilegeEnt) String() string {
-	return fmt.Sprintf("type=Privilege,subject=%s,computer=%s,count=%d,ft=%s,lt=%s",
-		e.Subject, e.Computer, e.Count,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339),
+func (e *privilegeEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Privilege", "subject", e.Subject, "computer", e.Computer, "count", e.Count,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
 	)
 }
 
 var privilegeMap sync.Map
 
-func updatePrivilege(s *System, l string, t time.Time) {
-	subjectUserName := getEventData(reSubjectUserName, l)
-	subjectDomainName := getEventData(reSubjectDomainName, l)
-	switch subjectUserName {
-	case "LOCAL SERVICE", "SYSTEM":
-		// Skip System
-		return
+func updatePrivilege(ev *Event, t time.Time) {
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
+	for _, u := range privilegeSkipUsers {
+		if strings.EqualFold(subjectUserName, u) {
+			// Skip System
+			return
+		}
 	}
 	ts := t.Unix()
 	subject := fmt.Sprintf("%s@%s", subjectUserName, subjectDomainName)
@@ -49,7 +48,7 @@ func updatePrivilege(s *System, l string, t time.Time) {
 	e := &privilegeEnt{
 		Count:     1,
 		Subject:   subject,
-		Computer:  s.Computer,
+		Computer:  ev.System.Computer,
 		LastTime:  ts,
 		FirstTime: ts,
 	}
@@ -62,11 +61,11 @@ func sendPrivilege() {
 			if debug {
 				log.Printf("privilege id=%s,e=%v", k, e)
 			}
-			privilegeCount++
+			privilegeCount.Add(1)
 			sendSyslog(&syslogEnt{
 				Severity: 6,
 				Time:     time.Now(),
-				Msg:      e.String(),
+				Fields:   e.Fields(),
 			})
 			publishMQTT(&mqttPrivilegeDataEnt{
 				Time:      time.Now().Format(time.RFC3339),
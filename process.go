@@ -1,21 +1,13 @@
-//go:build windows
-
 package main
 
 import (
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
 )
 
-var reNewProcessName = regexp.MustCompile(`<Data Name='NewProcessName'>([^<]+)</Data>`)
-var reProcessName = regexp.MustCompile(`<Data Name='ProcessName'>([^<]+)</Data>`)
-var reParentProcessName = regexp.MustCompile(`<Data Name='ParentProcessName'>([^<]+)</Data>`)
-var reStatus = regexp.MustCompile(`<Data Name='Status'>([^<]+)</Data>`)
-
 // <Data Name='SubjectUserName'>DESKTOP-T6L1D1U$</Data>
 // <Data Name='SubjectDomainName'>WORKGROUP</Data>
 // <Data Name='NewProcessName'>C:\Users\myamai\AppData\Local\Programs\Microsoft VS Code\Code.exe</Data>
@@ -37,41 +29,41 @@ type processEnt struct {
 	SendTime    int64
 }
 
-func (e *processEnt) String() string {
-	return fmt.Sprintf("type=Process,computer=%s,process=%s,count=%d,start=%d,exit=%d,subject=%s,status=%s,parent=%s,ft=%s,lt=%s",
-		e.Computer, e.Process, e.Count, e.StartCount, e.ExitCount,
-		e.LastSubject, e.LastStatus, e.LastParent,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339),
+func (e *processEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Process", "computer", e.Computer, "process", e.Process,
+		"count", e.Count, "start", e.StartCount, "exit", e.ExitCount,
+		"subject", e.LastSubject, "status", e.LastStatus, "parent", e.LastParent,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
 	)
 }
 
 var processMap sync.Map
 
-func updateProcess(s *System, l string, t time.Time) {
-	subjectUserName := getEventData(reSubjectUserName, l)
-	subjectDomainName := getEventData(reSubjectDomainName, l)
+func updateProcess(ev *Event, t time.Time) {
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
 	process := ""
 	parent := ""
 	status := ""
 	ts := t.Unix()
-	switch s.EventID {
+	switch ev.System.EventID {
 	case 4688:
-		process = getEventData(reNewProcessName, l)
-		parent = getEventData(reParentProcessName, l)
+		process = ev.Get("NewProcessName")
+		parent = ev.Get("ParentProcessName")
 	case 4689:
-		process = getEventData(reProcessName, l)
-		status = getEventData(reStatus, l)
+		process = ev.Get("ProcessName")
+		status = ev.Get("Status")
 	default:
 		return
 	}
 	subject := fmt.Sprintf("%s@%s", subjectUserName, subjectDomainName)
-	id := fmt.Sprintf("%s:%s", s.Computer, process)
+	id := fmt.Sprintf("%s:%s", ev.System.Computer, process)
 
 	if v, ok := processMap.Load(id); ok {
 		if e, ok := v.(*processEnt); ok {
 			e.Count++
-			if s.EventID == 4688 {
+			if ev.System.EventID == 4688 {
 				// Start
 				e.StartCount++
 				e.LastSubject = subject
@@ -81,7 +73,7 @@ func updateProcess(s *System, l string, t time.Time) {
 				if strings.HasPrefix(status, "0x") {
 					e.LastStatus = status
 				} else {
-					log.Println("bad status", l)
+					log.Printf("bad status %s", status)
 				}
 			}
 			if e.LastTime < ts {
@@ -91,7 +83,7 @@ func updateProcess(s *System, l string, t time.Time) {
 		return
 	}
 	e := &processEnt{
-		Computer:    s.Computer,
+		Computer:    ev.System.Computer,
 		Process:     process,
 		Count:       1,
 		LastSubject: subject,
@@ -99,7 +91,7 @@ func updateProcess(s *System, l string, t time.Time) {
 		LastTime:    ts,
 		FirstTime:   ts,
 	}
-	if s.EventID == 4688 {
+	if ev.System.EventID == 4688 {
 		e.StartCount++
 	} else {
 		e.ExitCount++
@@ -111,11 +103,11 @@ func updateProcess(s *System, l string, t time.Time) {
 func sendProcess() {
 	processMap.Range(func(k, v interface{}) bool {
 		if e, ok := v.(*processEnt); ok {
-			processCount++
+			processCount.Add(1)
 			sendSyslog(&syslogEnt{
 				Severity: 6,
 				Time:     time.Now(),
-				Msg:      e.String(),
+				Fields:   e.Fields(),
 			})
 			publishMQTT(&mqttProcessDataEnt{
 				Time:        time.Now().Format(time.RFC3339),
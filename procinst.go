@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// プロセスの起動から終了までをPIDで追跡する
+
+// <Data Name='NewProcessId'>0x1a2c</Data>
+// <Data Name='NewProcessName'>C:\Windows\System32\cmd.exe</Data>
+// <Data Name='TokenElevationType'>%%1936</Data>
+// <Data Name='ProcessId'>0x1f40</Data>
+// <Data Name='CommandLine'>cmd.exe /c whoami</Data>
+// <Data Name='MandatoryLabel'>S-1-16-12288</Data>
+// <Data Name='ParentProcessName'>C:\Windows\explorer.exe</Data>
+// 4689
+// <Data Name='ProcessId'>0x1a2c</Data>
+// <Data Name='ProcessName'>C:\Windows\System32\cmd.exe</Data>
+// <Data Name='Status'>0x0</Data>
+
+type processInstanceEnt struct {
+	Computer    string
+	PID         string
+	PPID        string
+	Process     string
+	CommandLine string
+	Chain       string
+	Subject     string
+	Elevation   string
+	Integrity   string
+	Status      string
+	StartTime   int64
+	EndTime     int64
+}
+
+func (e *processInstanceEnt) Fields(state string) syslogFields {
+	return newSyslogFields("type", "ProcessInstance", "computer", e.Computer, "pid", e.PID, "ppid", e.PPID,
+		"process", e.Process, "commandLine", e.CommandLine, "chain", e.Chain, "subject", e.Subject,
+		"elevation", e.Elevation, "integrity", e.Integrity, "state", state, "status", e.Status,
+		"duration", e.EndTime-e.StartTime,
+		"start", time.Unix(e.StartTime, 0).Format(time.RFC3339),
+		"end", time.Unix(e.EndTime, 0).Format(time.RFC3339),
+	)
+}
+
+var processInstanceMap sync.Map
+var processInstanceCount atomic.Int64
+
+// maxProcessChain : 親プロセスをたどる数
+const maxProcessChain = 5
+
+func updateProcessInstance(ev *Event, t time.Time) {
+	ts := t.Unix()
+	switch ev.System.EventID {
+	case 4688:
+		pid := ev.Get("NewProcessId")
+		if pid == "" {
+			return
+		}
+		process := ev.Get("NewProcessName")
+		ppid := ev.Get("ProcessId")
+		parent := filepath.Base(strings.ReplaceAll(ev.Get("ParentProcessName"), "\\", "/"))
+		chain := parent
+		if v, ok := processInstanceMap.Load(ev.System.Computer + ":" + ppid); ok {
+			if p, ok := v.(*processInstanceEnt); ok {
+				chain = p.Chain + ">" + parent
+				if a := strings.Split(chain, ">"); len(a) > maxProcessChain {
+					chain = strings.Join(a[len(a)-maxProcessChain:], ">")
+				}
+			}
+		}
+		id := ev.System.Computer + ":" + pid
+		// PIDが再利用されたか4689がなかった時は前のプロセスを送信する
+		if v, ok := processInstanceMap.LoadAndDelete(id); ok {
+			if e, ok := v.(*processInstanceEnt); ok {
+				e.EndTime = ts
+				sendProcessInstance(e, "Replaced")
+			}
+		}
+		processInstanceMap.Store(id, &processInstanceEnt{
+			Computer:    ev.System.Computer,
+			PID:         pid,
+			PPID:        ppid,
+			Process:     process,
+			CommandLine: ev.Get("CommandLine"),
+			Chain:       strings.TrimPrefix(chain, ">"),
+			Subject:     fmt.Sprintf("%s@%s", ev.Get("SubjectUserName"), ev.Get("SubjectDomainName")),
+			Elevation:   getTokenElevationType(ev.Get("TokenElevationType")),
+			Integrity:   getMandatoryLabel(ev.Get("MandatoryLabel")),
+			StartTime:   ts,
+		})
+	case 4689:
+		id := ev.System.Computer + ":" + ev.Get("ProcessId")
+		if v, ok := processInstanceMap.LoadAndDelete(id); ok {
+			if e, ok := v.(*processInstanceEnt); ok {
+				e.EndTime = ts
+				e.Status = ev.Get("Status")
+				sendProcessInstance(e, "Exit")
+			}
+		}
+	}
+}
+
+func getTokenElevationType(s string) string {
+	switch s {
+	case "%%1936":
+		return "Default"
+	case "%%1937":
+		return "Full"
+	case "%%1938":
+		return "Limited"
+	}
+	return s
+}
+
+func getMandatoryLabel(s string) string {
+	switch strings.ToUpper(s) {
+	case "S-1-16-0":
+		return "Untrusted"
+	case "S-1-16-4096":
+		return "Low"
+	case "S-1-16-8192":
+		return "Medium"
+	case "S-1-16-8448":
+		return "MediumPlus"
+	case "S-1-16-12288":
+		return "High"
+	case "S-1-16-16384":
+		return "System"
+	case "S-1-16-20480":
+		return "Protected"
+	}
+	return s
+}
+
+// expireProcessInstances : 終了しないまま-processTTLを過ぎたプロセスを送信して削除する
+func expireProcessInstances() {
+	now := getCheckTime()
+	ttl := int64(processTTL) * 3600
+	processInstanceMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*processInstanceEnt); ok {
+			if now-e.StartTime > ttl {
+				e.EndTime = now
+				sendProcessInstance(e, "Expired")
+				processInstanceMap.Delete(k)
+			}
+		}
+		return true
+	})
+}
+
+func sendProcessInstance(e *processInstanceEnt, state string) {
+	processInstanceCount.Add(1)
+	sendSyslog(&syslogEnt{
+		Severity: 6,
+		Time:     time.Unix(e.EndTime, 0),
+		Fields:   e.Fields(state),
+	})
+	publishMQTT(&mqttProcessInstanceDataEnt{
+		Time:        time.Now().Format(time.RFC3339),
+		Computer:    e.Computer,
+		PID:         e.PID,
+		PPID:        e.PPID,
+		Process:     e.Process,
+		CommandLine: e.CommandLine,
+		Chain:       e.Chain,
+		Subject:     e.Subject,
+		Elevation:   e.Elevation,
+		Integrity:   e.Integrity,
+		State:       state,
+		Status:      e.Status,
+		Duration:    e.EndTime - e.StartTime,
+		StartTime:   time.Unix(e.StartTime, 0).Format(time.RFC3339),
+		EndTime:     time.Unix(e.EndTime, 0).Format(time.RFC3339),
+	})
+}
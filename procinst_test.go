@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 同じPIDのプロセスが起動した時は前のプロセスをReplacedで送信すること
+func TestProcessInstanceReplaced(t *testing.T) {
+	defer processInstanceMap.Clear()
+	drainSyslog()
+	start := func(rec int, ts, pid, ppid, name string) string {
+		return makeReplayEvent(4688, rec, ts, map[string]string{
+			"NewProcessId":      pid,
+			"ProcessId":         ppid,
+			"NewProcessName":    `C:\Windows\System32\` + name,
+			"ParentProcessName": `C:\Windows\explorer.exe`,
+			"SubjectUserName":   "alice",
+		})
+	}
+	xml := start(1, "2025-01-23T08:00:00Z", "0x100", "0x10", "cmd.exe")
+	// 4689がないまま同じPIDが再利用された
+	xml += start(2, "2025-01-23T08:00:10Z", "0x100", "0x10", "notepad.exe")
+	xml += makeReplayEvent(4689, 3, "2025-01-23T08:00:15Z", map[string]string{
+		"ProcessId":   "0x100",
+		"ProcessName": `C:\Windows\System32\notepad.exe`,
+		"Status":      "0x0",
+	})
+	checkEvents(xml)
+	got := []string{}
+	for _, m := range drainSyslog() {
+		if strings.Contains(m, "type=ProcessInstance") {
+			got = append(got, m)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("records=%d %v", len(got), got)
+	}
+	tests := []struct {
+		process  string
+		state    string
+		duration string
+	}{
+		{`process=C:\Windows\System32\cmd.exe`, "state=Replaced", "duration=10"},
+		{`process=C:\Windows\System32\notepad.exe`, "state=Exit", "duration=5"},
+	}
+	for i, tt := range tests {
+		for _, s := range []string{tt.process, tt.state, tt.duration} {
+			if !strings.Contains(got[i], s) {
+				t.Errorf("record %d no %s in %s", i, s, got[i])
+			}
+		}
+	}
+	n := 0
+	processInstanceMap.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Errorf("instances=%d", n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// remoteEnt : 監視するWindows PC
+type remoteEnt struct {
+	Host     string
+	User     string
+	Password string
+	Auth     string
+	Channels []*channelEnt
+	// expanded : *と?を展開したチャンネル
+	expanded atomic.Pointer[[]*channelEnt]
+	lastTime time.Time
+	total    int
+	// メトリクスで参照する最後の読み込みの時刻と処理時間
+	pollTime     atomic.Int64
+	pollDuration atomic.Int64
+	pollEvents   atomic.Int64
+}
+
+var remoteList = []*remoteEnt{}
+
+// configRemotes : 設定ファイルのリモートPC
+var configRemotes []*remoteEnt
+
+// key : ブックマークやStatsのparamに使う名前
+func (r *remoteEnt) key() string {
+	if r.Host == "" {
+		return "LOCAL"
+	}
+	return r.Host
+}
+
+// channels : 展開する前は*と?を含むチャンネルを除く
+func (r *remoteEnt) channels() []*channelEnt {
+	if l := r.expanded.Load(); l != nil {
+		return *l
+	}
+	return expandChannels(r.configChannels(), nil)
+}
+
+// configChannels : リモートPCごとに指定がなければ共通のチャンネル
+func (r *remoteEnt) configChannels() []*channelEnt {
+	if len(r.Channels) > 0 {
+		return r.Channels
+	}
+	return channelList
+}
+
+// setupRemotes : -remoteはカンマ区切りで複数指定できる。認証情報は共通
+func setupRemotes() {
+	if configRemotes != nil && !flagSet["remote"] {
+		remoteList = configRemotes
+		return
+	}
+	remoteList = []*remoteEnt{}
+	for _, h := range strings.Split(remote, ",") {
+		remoteList = append(remoteList, &remoteEnt{
+			Host:     strings.TrimSpace(h),
+			User:     user,
+			Password: password,
+			Auth:     auth,
+		})
+	}
+}
+
+// getRemoteParam : 監視しているPCのリスト
+func getRemoteParam() string {
+	a := []string{}
+	for _, r := range remoteList {
+		a = append(a, r.key())
+	}
+	return strings.Join(a, ";")
+}
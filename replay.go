@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// isReplay : 保存したファイルからイベントを読み込むモード
+func isReplay() bool {
+	return replay != "" || evtxFile != ""
+}
+
+// startReplay : 保存したwevtutil qe /f:xmlの出力やEVTXファイルをイベントハンドラーに流す
+func startReplay(ctx context.Context, done chan bool) {
+	defer close(done)
+	files := []string{}
+	for _, p := range []string{replay, evtxFile} {
+		if p == "" {
+			continue
+		}
+		l, err := getReplayFiles(p)
+		if err != nil {
+			log.Printf("replay err=%v", err)
+			return
+		}
+		files = append(files, l...)
+	}
+	total := 0
+	for _, f := range files {
+		if ctx.Err() != nil {
+			log.Println("stop replay")
+			return
+		}
+		count := 0
+		if strings.EqualFold(filepath.Ext(f), ".evtx") {
+			count = replayEvtx(f)
+		} else {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				log.Printf("replay err=%v file=%s", err, f)
+				continue
+			}
+			count, _ = checkEvents(decodeReplayData(b))
+		}
+		log.Printf("replay file=%s count=%d", f, count)
+		total += count
+	}
+	sendStats(total, total, "REPLAY")
+	sendReport("REPLAY")
+	log.Printf("replay done files=%d total=%d", len(files), total)
+}
+
+// getReplayFiles : リプレイするファイルのリストを取得する
+func getReplayFiles(path string) ([]string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return []string{path}, nil
+	}
+	ret := []string{}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if ext := filepath.Ext(p); strings.EqualFold(ext, ".xml") || strings.EqualFold(ext, ".evtx") {
+			ret = append(ret, p)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// replayEvtx : EVTXファイルのレコードをXMLに変換して処理する
+func replayEvtx(path string) int {
+	count := 0
+	sb := &strings.Builder{}
+	n, err := readEvtx(path, func(x string) {
+		sb.WriteString(x)
+		sb.WriteString("\n")
+		if sb.Len() > 1024*1024 {
+			n, _ := checkEvents(sb.String())
+			count += n
+			sb.Reset()
+		}
+	})
+	if err != nil {
+		log.Printf("replay err=%v file=%s", err, path)
+		return 0
+	}
+	c, _ := checkEvents(sb.String())
+	count += c
+	if count != n {
+		log.Printf("replay evtx file=%s records=%d events=%d", path, n, count)
+	}
+	return count
+}
+
+// decodeReplayData : PowerShellでリダイレクトしたUTF-16のファイルにも対応する
+func decodeReplayData(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		return decodeUTF16(b[2:], false)
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		return decodeUTF16(b[2:], true)
+	}
+	return string(b)
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func drainSyslog() []string {
+	ret := []string{}
+	for {
+		select {
+		case m := <-syslogCh:
+			ret = append(ret, m.Msg)
+		default:
+			return ret
+		}
+	}
+}
+
+func makeReplayEvent(eventID int, rec int, t string, data map[string]string) string {
+	d := ""
+	for k, v := range data {
+		d += fmt.Sprintf("<Data Name='%s'>%s</Data>", k, v)
+	}
+	return fmt.Sprintf("<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'><System>"+
+		"<Provider Name='Microsoft-Windows-Security-Auditing'/><EventID>%d</EventID><Level>0</Level>"+
+		"<TimeCreated SystemTime='%s'/><EventRecordID>%d</EventRecordID><Channel>Security</Channel>"+
+		"<Computer>DC01.contoso.local</Computer><Security/></System><EventData>%s</EventData></Event>\r\n", eventID, t, rec, d)
+}
+
+// 保存したXMLからブルートフォースとログの消去を検知できること
+func TestReplayDetection(t *testing.T) {
+	replay = t.TempDir()
+	defer func() { replay = "" }()
+	drainSyslog()
+	xml := ""
+	for i := 0; i < bruteForceThreshold; i++ {
+		xml += makeReplayEvent(4625, i+1, fmt.Sprintf("2025-01-23T08:00:%02dZ", i), map[string]string{
+			"TargetUserName": "bob",
+			"IpAddress":      fmt.Sprintf("10.0.0.%d", i+1),
+			"SubStatus":      "0xc000006a",
+			"LogonType":      "3",
+		})
+	}
+	xml += makeReplayEvent(1102, 100, "2025-01-23T08:01:00Z", map[string]string{"SubjectUserName": "mallory"})
+	// PowerShellでリダイレクトしたUTF-16LEのファイル
+	u := utf16.Encode([]rune(xml))
+	b := []byte{0xff, 0xfe}
+	for _, c := range u {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	if err := os.WriteFile(filepath.Join(replay, "security.xml"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(replay, "memo.txt"), []byte("skip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files, err := getReplayFiles(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files=%v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, lastID := checkEvents(decodeReplayData(data))
+	if n != bruteForceThreshold+1 || lastID != 100 {
+		t.Errorf("count=%d lastID=%d", n, lastID)
+	}
+	want := map[string]bool{"alert=BruteForce": false, "type=ClearLog": false, "type=LogonFailed": false}
+	for _, m := range drainSyslog() {
+		for k := range want {
+			if strings.Contains(m, k) {
+				want[k] = true
+			}
+		}
+	}
+	for k, ok := range want {
+		if !ok {
+			t.Errorf("no %s", k)
+		}
+	}
+}
+
+func TestDecodeReplayData(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"utf8", []byte("<Event>")},
+		{"utf8bom", []byte("\xef\xbb\xbf<Event>")},
+		{"utf16le", []byte("\xff\xfe<\x00E\x00v\x00e\x00n\x00t\x00>\x00")},
+		{"utf16be", []byte("\xfe\xff\x00<\x00E\x00v\x00e\x00n\x00t\x00>")},
+	}
+	for _, tt := range tests {
+		if got := decodeReplayData(tt.data); got != "<Event>" {
+			t.Errorf("%s=%q", tt.name, got)
+		}
+	}
+}
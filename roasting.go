@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Kerberoasting と AS-REP roasting を検知する
+
+type kerberosReqEnt struct {
+	Time    int64
+	Service string
+}
+
+// kerberosSTByAccount : アカウントごとのサービスチケットの要求
+var kerberosSTByAccount = make(map[string][]kerberosReqEnt)
+
+// checkRoastingEvent : kerberosのハンドラーとは別に4768/4769を確認する
+func checkRoastingEvent(ev *Event, t time.Time) {
+	if getKerberosFailCode(ev.Get("Status")) != "" {
+		return
+	}
+	ticketType := "TGT"
+	if ev.System.EventID == 4769 {
+		ticketType = "ST"
+	}
+	checkRoasting(ev.System.Computer, ev.Get("TargetUserName"), ev.Get("IpAddress"), ev.Get("ServiceName"),
+		ticketType, getKerberosEncType(ev.Get("TicketEncryptionType")), ev.Get("PreAuthType"), t)
+}
+
+// checkRoasting : 成功した4768/4769から呼び出す
+func checkRoasting(computer, user, ip, service, ticketType, encType, preAuth string, t time.Time) {
+	ts := t.Unix()
+	ip = strings.TrimPrefix(ip, "::ffff:")
+	account := strings.ToLower(strings.SplitN(user, "@", 2)[0])
+	svc := strings.ToLower(service)
+	if ticketType == "TGT" {
+		// 事前認証なしのTGTはオフラインでパスワードを解読される
+		if preAuth == "0" && checkAuthAlertTime("asrep:"+account, ts) {
+			sendAlert("ASREPRoasting", computer, t,
+				"target", user, "ip", ip, "encType", encType, "preAuth", preAuth)
+		}
+		return
+	}
+	if svc == "" || svc == "krbtgt" || strings.HasSuffix(account, "$") {
+		return
+	}
+	// コンピュータアカウント以外のSPNにRC4のチケットを要求
+	if strings.HasPrefix(encType, "RC4") && !strings.HasSuffix(svc, "$") &&
+		checkAuthAlertTime("rc4:"+account+":"+svc, ts) {
+		sendAlert("Kerberoasting", computer, t,
+			"target", user, "ip", ip, "service", service, "encType", encType)
+	}
+	if stBurstThreshold < 1 {
+		return
+	}
+	l := append(kerberosSTByAccount[account], kerberosReqEnt{Time: ts, Service: svc})
+	l = pruneKerberosReq(l, ts)
+	kerberosSTByAccount[account] = l
+	services := make(map[string]bool)
+	for _, r := range l {
+		services[r.Service] = true
+	}
+	if len(services) >= stBurstThreshold && checkAuthAlertTime("st:"+account, ts) {
+		sendAlert("ServiceTicketBurst", computer, t,
+			"target", user, "ip", ip, "services", len(services), "requests", len(l),
+			"window", detectWindow, "spn", joinAuthFailKeys(services))
+	}
+}
+
+func pruneKerberosReq(l []kerberosReqEnt, ts int64) []kerberosReqEnt {
+	i := 0
+	for i < len(l) && l[i].Time <= ts-int64(detectWindow) {
+		i++
+	}
+	return l[i:]
+}
+
+// cleanupRoasting : 時間枠を過ぎた要求を削除する
+func cleanupRoasting() {
+	now := getCheckTime()
+	for k, l := range kerberosSTByAccount {
+		if l = pruneKerberosReq(l, now); len(l) < 1 {
+			delete(kerberosSTByAccount, k)
+		} else {
+			kerberosSTByAccount[k] = l
+		}
+	}
+}
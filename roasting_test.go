@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// kerberosのハンドラーを無効にしてもroastingを検知すること
+func TestRoastingWithoutKerberosHandler(t *testing.T) {
+	handlerEnabled = map[string]bool{"kerberos": false}
+	defer func() { handlerEnabled = make(map[string]bool) }()
+	drainSyslog()
+	xml := makeReplayEvent(4768, 1, "2025-01-23T09:00:00Z", map[string]string{
+		"TargetUserName":       "svc_nopreauth",
+		"IpAddress":            "::ffff:10.0.0.5",
+		"Status":               "0x0",
+		"PreAuthType":          "0",
+		"TicketEncryptionType": "0x17",
+	})
+	xml += makeReplayEvent(4769, 2, "2025-01-23T09:00:01Z", map[string]string{
+		"TargetUserName":       "alice@CONTOSO.LOCAL",
+		"ServiceName":          "MSSQLSvc",
+		"IpAddress":            "::ffff:10.0.0.5",
+		"Status":               "0x0",
+		"TicketEncryptionType": "0x17",
+	})
+	checkEvents(xml)
+	want := map[string]bool{"alert=ASREPRoasting": false, "alert=Kerberoasting": false}
+	for _, m := range drainSyslog() {
+		if strings.Contains(m, "type=Kerberos,") {
+			t.Errorf("kerberos report with disabled handler %s", m)
+		}
+		for k := range want {
+			if strings.Contains(m, k) {
+				want[k] = true
+			}
+		}
+	}
+	for k, ok := range want {
+		if !ok {
+			t.Errorf("no %s", k)
+		}
+	}
+}
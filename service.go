@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 新しいサービスのインストールを監視する
+
+type serviceEnt struct {
+	Computer    string
+	Name        string
+	Image       string
+	ServiceType string
+	StartType   string
+	Account     string
+	Subject     string
+	Count       int
+	FirstTime   int64
+	LastTime    int64
+}
+
+// Security 4697
+// <Data Name="SubjectUserName">dadmin</Data>
+// <Data Name="SubjectDomainName">CONTOSO</Data>
+// <Data Name="ServiceName">PSEXESVC</Data>
+// <Data Name="ServiceFileName">%SystemRoot%\PSEXESVC.exe</Data>
+// <Data Name="ServiceType">0x10</Data>
+// <Data Name="ServiceStartType">3</Data>
+// <Data Name="ServiceAccount">LocalSystem</Data>
+// System 7045
+// <Data Name="ServiceName">PSEXESVC</Data>
+// <Data Name="ImagePath">%SystemRoot%\PSEXESVC.exe</Data>
+// <Data Name="ServiceType">user mode service</Data>
+// <Data Name="StartType">demand start</Data>
+// <Data Name="AccountName">LocalSystem</Data>
+
+func (e *serviceEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Service", "computer", e.Computer, "service", e.Name, "image", e.Image,
+		"serviceType", e.ServiceType, "startType", e.StartType, "account", e.Account, "subject", e.Subject,
+		"count", e.Count,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
+	)
+}
+
+var serviceMap sync.Map
+var serviceCount atomic.Int64
+
+func updateService(ev *Event, t time.Time) {
+	name := ev.Get("ServiceName")
+	if name == "" {
+		return
+	}
+	image := ev.Get("ServiceFileName")
+	account := ev.Get("ServiceAccount")
+	startType := getServiceStartType(ev.Get("ServiceStartType"))
+	subject := ""
+	if ev.System.EventID == 7045 {
+		image = ev.Get("ImagePath")
+		account = ev.Get("AccountName")
+		startType = getServiceStartType(ev.Get("StartType"))
+	} else {
+		subject = fmt.Sprintf("%s@%s", ev.Get("SubjectUserName"), ev.Get("SubjectDomainName"))
+	}
+	serviceType := getServiceType(ev.Get("ServiceType"))
+	ts := t.Unix()
+	if setFirstSeen("service", strings.ToUpper(ev.System.Computer+":"+name), ts) {
+		sendAlert("NewService", ev.System.Computer, t,
+			"service", name, "image", image, "serviceType", serviceType, "startType", startType,
+			"account", account, "subject", subject, "eventID", ev.System.EventID)
+	}
+	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s", ev.System.Computer, name, image))
+	if v, ok := serviceMap.Load(id); ok {
+		if e, ok := v.(*serviceEnt); ok {
+			e.Count++
+			if subject != "" {
+				e.Subject = subject
+			}
+			if e.LastTime < ts {
+				e.LastTime = ts
+			}
+		}
+		return
+	}
+	serviceMap.Store(id, &serviceEnt{
+		Computer:    ev.System.Computer,
+		Name:        name,
+		Image:       image,
+		ServiceType: serviceType,
+		StartType:   startType,
+		Account:     account,
+		Subject:     subject,
+		Count:       1,
+		FirstTime:   ts,
+		LastTime:    ts,
+	})
+}
+
+// getServiceType : 4697は数値、7045は文字列
+func getServiceType(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return ""
+	case "0x1", "kernel mode driver":
+		return "KernelDriver"
+	case "0x2", "file system driver":
+		return "FileSystemDriver"
+	case "0x10", "user mode service":
+		return "OwnProcess"
+	case "0x20":
+		return "ShareProcess"
+	case "0x110", "0x120":
+		return "Interactive"
+	}
+	return s
+}
+
+func getServiceStartType(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return ""
+	case "0", "boot start":
+		return "Boot"
+	case "1", "system start":
+		return "System"
+	case "2", "auto start":
+		return "Auto"
+	case "3", "demand start":
+		return "Demand"
+	case "4", "disabled":
+		return "Disabled"
+	}
+	return s
+}
+
+func sendService() {
+	serviceMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*serviceEnt); ok {
+			if debug {
+				log.Printf("service id=%s,e=%v", k, e)
+			}
+			serviceCount.Add(1)
+			sendSyslog(&syslogEnt{
+				Severity: 6,
+				Time:     time.Now(),
+				Fields:   e.Fields(),
+			})
+			publishMQTT(&mqttServiceDataEnt{
+				Time:        time.Now().Format(time.RFC3339),
+				Computer:    e.Computer,
+				Name:        e.Name,
+				Image:       e.Image,
+				ServiceType: e.ServiceType,
+				StartType:   e.StartType,
+				Account:     e.Account,
+				Subject:     e.Subject,
+				Count:       e.Count,
+				FirstTime:   time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+				LastTime:    time.Unix(e.LastTime, 0).Format(time.RFC3339),
+			})
+			serviceMap.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ログオンからログオフまでのセッションをTargetLogonIdで追跡する
+
+// <Data Name='TargetUserName'>alice</Data>
+// <Data Name='TargetDomainName'>CONTOSO</Data>
+// <Data Name='TargetLogonId'>0x3e7a1f</Data>
+// <Data Name='LogonType'>10</Data>
+// <Data Name='IpAddress'>10.0.0.5</Data>
+// <Data Name='ElevatedToken'>%%1842</Data>
+
+type sessionEnt struct {
+	Computer   string
+	LogonID    string
+	Target     string
+	IP         string
+	LogonType  string
+	Elevated   bool
+	LogonTime  int64
+	LogoffTime int64
+}
+
+func (e *sessionEnt) Fields(status string) syslogFields {
+	return newSyslogFields("type", "Session", "target", e.Target, "computer", e.Computer, "logonID", e.LogonID,
+		"ip", e.IP, "logonType", e.LogonType, "elevated", e.Elevated, "status", status,
+		"duration", e.LogoffTime-e.LogonTime,
+		"start", time.Unix(e.LogonTime, 0).Format(time.RFC3339),
+		"end", time.Unix(e.LogoffTime, 0).Format(time.RFC3339),
+	)
+}
+
+var sessionMap sync.Map
+var sessionCount atomic.Int64
+
+func checkSession(ev *Event, t time.Time) {
+	logonType := getLogonType(ev.Get("LogonType"))
+	for _, s := range logonSkipTypes {
+		if logonType == s {
+			return
+		}
+	}
+	logonID := ev.Get("TargetLogonId")
+	if logonID == "" {
+		return
+	}
+	ts := t.Unix()
+	id := fmt.Sprintf("%s:%s", ev.System.Computer, logonID)
+	switch ev.System.EventID {
+	case 4624:
+		sessionMap.Store(id, &sessionEnt{
+			Computer:  ev.System.Computer,
+			LogonID:   logonID,
+			Target:    fmt.Sprintf("%s@%s", ev.Get("TargetUserName"), ev.Get("TargetDomainName")),
+			IP:        ev.Get("IpAddress"),
+			LogonType: logonType,
+			Elevated:  isElevatedToken(ev.Get("ElevatedToken")),
+			LogonTime: ts,
+		})
+	case 4634, 4647:
+		// 4647の後に4634が来ることがあるので最初のログオフで終了する
+		if v, ok := sessionMap.LoadAndDelete(id); ok {
+			if e, ok := v.(*sessionEnt); ok {
+				e.LogoffTime = ts
+				sendSession(e, "Logoff")
+			}
+		}
+	}
+}
+
+// isElevatedToken : %%1842はYes、%%1843はNo
+func isElevatedToken(s string) bool {
+	return s == "%%1842" || s == "Yes"
+}
+
+// expireSessions : TTLを過ぎてもログオフしないセッションを送信して削除する
+func expireSessions() {
+	now := getCheckTime()
+	ttl := int64(sessionTTL) * 3600
+	sessionMap.Range(func(k, v interface{}) bool {
+		if e, ok := v.(*sessionEnt); ok {
+			if now-e.LogonTime > ttl {
+				e.LogoffTime = now
+				sendSession(e, "Expired")
+				sessionMap.Delete(k)
+			}
+		}
+		return true
+	})
+}
+
+func sendSession(e *sessionEnt, status string) {
+	sessionCount.Add(1)
+	sendSyslog(&syslogEnt{
+		Severity: 6,
+		Time:     time.Unix(e.LogoffTime, 0),
+		Fields:   e.Fields(status),
+	})
+	publishMQTT(&mqttSessionDataEnt{
+		Time:      time.Now().Format(time.RFC3339),
+		Target:    e.Target,
+		Computer:  e.Computer,
+		LogonID:   e.LogonID,
+		IP:        e.IP,
+		LogonType: e.LogonType,
+		Elevated:  e.Elevated,
+		Status:    status,
+		Duration:  e.LogoffTime - e.LogonTime,
+		StartTime: time.Unix(e.LogonTime, 0).Format(time.RFC3339),
+		EndTime:   time.Unix(e.LogoffTime, 0).Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,1038 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sigmaルールのlogsourceとdetectionをコンパイルしてイベントと照合する
+
+// sigmaRuleConfigEnt : SigmaルールのYAML
+type sigmaRuleConfigEnt struct {
+	Title     string   `yaml:"title"`
+	ID        string   `yaml:"id"`
+	Status    string   `yaml:"status"`
+	Level     string   `yaml:"level"`
+	Tags      []string `yaml:"tags"`
+	Logsource struct {
+		Product  string `yaml:"product"`
+		Category string `yaml:"category"`
+		Service  string `yaml:"service"`
+	} `yaml:"logsource"`
+	Detection map[string]interface{} `yaml:"detection"`
+}
+
+// sigmaRuleEnt : コンパイルしたルール
+type sigmaRuleEnt struct {
+	ID      string
+	Title   string
+	Level   string
+	Tags    []string
+	File    string
+	Fields  []string
+	Count   int
+	sources []*sigmaSourceEnt
+	search  map[string]*sigmaSearchEnt
+	cond    sigmaCondFunc
+}
+
+// sigmaSourceEnt : logsourceに対応するチャネルとイベントID
+type sigmaSourceEnt struct {
+	Channel  string
+	EventIDs []int
+	// Alias : Sigmaのフィールド名 -> EventDataの名前
+	Alias map[string]string
+}
+
+// sigmaSearchEnt : detectionの検索条件。mapsはORでつないだANDの条件
+type sigmaSearchEnt struct {
+	maps     [][]*sigmaFieldEnt
+	keywords []*sigmaValueEnt
+}
+
+// sigmaFieldEnt : Field|contains|all: [a, b]
+type sigmaFieldEnt struct {
+	Field  string
+	All    bool
+	Exists *bool
+	Values []*sigmaValueEnt
+}
+
+// sigmaValueEnt : 比較する値。opはeq,contains,startswith,endswith,re,cidr,gt,gte,lt,lte
+type sigmaValueEnt struct {
+	null  bool
+	op    string
+	s     string
+	cased bool
+	re    *regexp.Regexp
+	ipnet *net.IPNet
+	num   float64
+}
+
+type sigmaCondFunc func(m func(string) bool) bool
+
+var sigmaDir = ""
+var sigmaRules = []*sigmaRuleEnt{}
+var sigmaCount atomic.Int64
+
+const sigmaSysmon = "Microsoft-Windows-Sysmon/Operational"
+const sigmaPowerShell = "Microsoft-Windows-PowerShell/Operational"
+
+// sigmaServiceMap : logsource.service -> チャネル
+var sigmaServiceMap = map[string]string{
+	"security":                             "Security",
+	"system":                               "System",
+	"application":                          "Application",
+	"sysmon":                               sigmaSysmon,
+	"powershell":                           sigmaPowerShell,
+	"powershell-classic":                   "Windows PowerShell",
+	"taskscheduler":                        "Microsoft-Windows-TaskScheduler/Operational",
+	"wmi":                                  "Microsoft-Windows-WMI-Activity/Operational",
+	"windefend":                            "Microsoft-Windows-Windows Defender/Operational",
+	"dns-server":                           "DNS Server",
+	"bits-client":                          "Microsoft-Windows-Bits-Client/Operational",
+	"codeintegrity-operational":            "Microsoft-Windows-CodeIntegrity/Operational",
+	"firewall-as":                          "Microsoft-Windows-Windows Firewall With Advanced Security/Firewall",
+	"terminalservices-localsessionmanager": "Microsoft-Windows-TerminalServices-LocalSessionManager/Operational",
+	"ntlm":                                 "Microsoft-Windows-NTLM/Operational",
+	"applocker":                            "Microsoft-Windows-AppLocker/EXE and DLL",
+}
+
+// sigmaProcessCreationAlias : 4688をprocess_creationのルールで照合する時のフィールド名
+var sigmaProcessCreationAlias = map[string]string{
+	"Image":           "NewProcessName",
+	"ParentImage":     "ParentProcessName",
+	"ProcessId":       "NewProcessId",
+	"ParentProcessId": "ProcessId",
+	"User":            "SubjectUserName",
+	"LogonId":         "SubjectLogonId",
+	"IntegrityLevel":  "MandatoryLabel",
+}
+
+// sigmaCategoryMap : logsource.category -> チャネルとイベントID
+var sigmaCategoryMap = map[string][]*sigmaSourceEnt{
+	"process_creation": {
+		{Channel: sigmaSysmon, EventIDs: []int{1}},
+		{Channel: "Security", EventIDs: []int{4688}, Alias: sigmaProcessCreationAlias},
+	},
+	"file_change":               {{Channel: sigmaSysmon, EventIDs: []int{2}}},
+	"network_connection":        {{Channel: sigmaSysmon, EventIDs: []int{3}}},
+	"sysmon_status":             {{Channel: sigmaSysmon, EventIDs: []int{4, 16}}},
+	"process_termination":       {{Channel: sigmaSysmon, EventIDs: []int{5}}},
+	"driver_load":               {{Channel: sigmaSysmon, EventIDs: []int{6}}},
+	"image_load":                {{Channel: sigmaSysmon, EventIDs: []int{7}}},
+	"create_remote_thread":      {{Channel: sigmaSysmon, EventIDs: []int{8}}},
+	"raw_access_thread":         {{Channel: sigmaSysmon, EventIDs: []int{9}}},
+	"process_access":            {{Channel: sigmaSysmon, EventIDs: []int{10}}},
+	"file_event":                {{Channel: sigmaSysmon, EventIDs: []int{11}}},
+	"registry_add":              {{Channel: sigmaSysmon, EventIDs: []int{12}}},
+	"registry_delete":           {{Channel: sigmaSysmon, EventIDs: []int{12}}},
+	"registry_set":              {{Channel: sigmaSysmon, EventIDs: []int{13}}},
+	"registry_rename":           {{Channel: sigmaSysmon, EventIDs: []int{14}}},
+	"registry_event":            {{Channel: sigmaSysmon, EventIDs: []int{12, 13, 14}}},
+	"create_stream_hash":        {{Channel: sigmaSysmon, EventIDs: []int{15}}},
+	"pipe_created":              {{Channel: sigmaSysmon, EventIDs: []int{17, 18}}},
+	"wmi_event":                 {{Channel: sigmaSysmon, EventIDs: []int{19, 20, 21}}},
+	"dns_query":                 {{Channel: sigmaSysmon, EventIDs: []int{22}}},
+	"file_delete":               {{Channel: sigmaSysmon, EventIDs: []int{23, 26}}},
+	"clipboard_capture":         {{Channel: sigmaSysmon, EventIDs: []int{24}}},
+	"process_tampering":         {{Channel: sigmaSysmon, EventIDs: []int{25}}},
+	"file_block":                {{Channel: sigmaSysmon, EventIDs: []int{27, 28}}},
+	"ps_module":                 {{Channel: sigmaPowerShell, EventIDs: []int{4103}}},
+	"ps_script":                 {{Channel: sigmaPowerShell, EventIDs: []int{4104}}},
+	"ps_classic_start":          {{Channel: "Windows PowerShell", EventIDs: []int{400}}},
+	"ps_classic_provider_start": {{Channel: "Windows PowerShell", EventIDs: []int{600}}},
+}
+
+// loadSigmaRules : ディレクトリの*.yml,*.yamlを読み込む
+// 対応していないルールはログに出力して読み飛ばす
+func loadSigmaRules() error {
+	if sigmaDir == "" {
+		return nil
+	}
+	rules := []*sigmaRuleEnt{}
+	skip := 0
+	err := filepath.WalkDir(sigmaDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if d.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			return nil
+		}
+		l, err := loadSigmaFile(p)
+		if err != nil {
+			log.Printf("sigma file=%s err=%v", p, err)
+			skip++
+			return nil
+		}
+		rules = append(rules, l...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	eventMu.Lock()
+	sigmaRules = rules
+	eventMu.Unlock()
+	log.Printf("load sigma rules=%d skip=%d dir=%s", len(rules), skip, sigmaDir)
+	return nil
+}
+
+func loadSigmaFile(p string) ([]*sigmaRuleEnt, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := []*sigmaRuleEnt{}
+	dec := yaml.NewDecoder(f)
+	for {
+		var c sigmaRuleConfigEnt
+		if err := dec.Decode(&c); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		// action: globalなどのdetectionがない文書は読み飛ばす
+		if c.Detection == nil {
+			continue
+		}
+		r, err := newSigmaRule(&c)
+		if err != nil {
+			return nil, err
+		}
+		r.File = p
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func newSigmaRule(c *sigmaRuleConfigEnt) (*sigmaRuleEnt, error) {
+	r := &sigmaRuleEnt{
+		ID:     c.ID,
+		Title:  c.Title,
+		Level:  strings.ToLower(c.Level),
+		Tags:   c.Tags,
+		search: make(map[string]*sigmaSearchEnt),
+	}
+	if r.Level == "" {
+		r.Level = "medium"
+	}
+	sources, err := getSigmaSources(c.Logsource.Product, c.Logsource.Service, c.Logsource.Category)
+	if err != nil {
+		return nil, err
+	}
+	r.sources = sources
+	conds := []string{}
+	fields := make(map[string]bool)
+	for k, v := range c.Detection {
+		switch k {
+		case "condition":
+			switch v := v.(type) {
+			case string:
+				conds = append(conds, v)
+			case []interface{}:
+				for _, e := range v {
+					conds = append(conds, fmt.Sprint(e))
+				}
+			default:
+				return nil, fmt.Errorf("condition: invalid type %T", v)
+			}
+		case "timeframe":
+		default:
+			s, err := newSigmaSearch(v, fields)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			r.search[k] = s
+		}
+	}
+	if len(conds) < 1 {
+		return nil, fmt.Errorf("condition: not found")
+	}
+	names := []string{}
+	for k := range r.search {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := []sigmaCondFunc{}
+	for _, s := range conds {
+		f, err := parseSigmaCondition(s, names)
+		if err != nil {
+			return nil, fmt.Errorf("condition: %v", err)
+		}
+		list = append(list, f)
+	}
+	r.cond = func(m func(string) bool) bool {
+		for _, f := range list {
+			if f(m) {
+				return true
+			}
+		}
+		return false
+	}
+	for k := range fields {
+		r.Fields = append(r.Fields, k)
+	}
+	sort.Strings(r.Fields)
+	return r, nil
+}
+
+// getSigmaSources : productはwindowsだけに対応する
+func getSigmaSources(product, service, category string) ([]*sigmaSourceEnt, error) {
+	if product != "" && !strings.EqualFold(product, "windows") {
+		return nil, fmt.Errorf("logsource: unsupported product %s", product)
+	}
+	if category != "" {
+		l, ok := sigmaCategoryMap[strings.ToLower(category)]
+		if !ok {
+			return nil, fmt.Errorf("logsource: unsupported category %s", category)
+		}
+		return l, nil
+	}
+	if service != "" {
+		ch, ok := sigmaServiceMap[strings.ToLower(service)]
+		if !ok {
+			return nil, fmt.Errorf("logsource: unsupported service %s", service)
+		}
+		return []*sigmaSourceEnt{{Channel: ch}}, nil
+	}
+	// 指定がない時は全てのチャネル
+	return []*sigmaSourceEnt{{}}, nil
+}
+
+// newSigmaSearch : map、mapのリスト、キーワードのリストに対応する
+func newSigmaSearch(v interface{}, fields map[string]bool) (*sigmaSearchEnt, error) {
+	s := &sigmaSearchEnt{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m, err := newSigmaFieldMap(v, fields)
+		if err != nil {
+			return nil, err
+		}
+		s.maps = append(s.maps, m)
+	case []interface{}:
+		for _, e := range v {
+			if em, ok := e.(map[string]interface{}); ok {
+				m, err := newSigmaFieldMap(em, fields)
+				if err != nil {
+					return nil, err
+				}
+				s.maps = append(s.maps, m)
+				continue
+			}
+			if len(s.maps) > 0 {
+				return nil, fmt.Errorf("mixed list of map and keyword")
+			}
+			kw, err := newSigmaValues(e, "contains", false, nil)
+			if err != nil {
+				return nil, err
+			}
+			s.keywords = append(s.keywords, kw...)
+		}
+		if len(s.maps) > 0 && len(s.keywords) > 0 {
+			return nil, fmt.Errorf("mixed list of map and keyword")
+		}
+	case string, int, float64:
+		kw, err := newSigmaValues(v, "contains", false, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.keywords = kw
+	default:
+		return nil, fmt.Errorf("invalid type %T", v)
+	}
+	return s, nil
+}
+
+func newSigmaFieldMap(m map[string]interface{}, fields map[string]bool) ([]*sigmaFieldEnt, error) {
+	ret := []*sigmaFieldEnt{}
+	for k, v := range m {
+		f, err := newSigmaField(k, v)
+		if err != nil {
+			return nil, err
+		}
+		switch f.Field {
+		case "", "EventID", "Channel", "Computer":
+		default:
+			fields[f.Field] = true
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// newSigmaField : Field|mod1|mod2の修飾子を解釈する
+func newSigmaField(key string, v interface{}) (*sigmaFieldEnt, error) {
+	a := strings.Split(key, "|")
+	f := &sigmaFieldEnt{Field: a[0]}
+	op := ""
+	cased := false
+	reFlags := ""
+	transforms := []string{}
+	for _, m := range a[1:] {
+		switch m {
+		case "contains", "startswith", "endswith", "re", "cidr", "gt", "gte", "lt", "lte", "exists":
+			if op != "" {
+				return nil, fmt.Errorf("%s: conflicting modifier %s", key, m)
+			}
+			op = m
+		case "all":
+			f.All = true
+		case "cased":
+			cased = true
+		case "base64", "base64offset", "windash", "wide", "utf16le":
+			transforms = append(transforms, m)
+		case "i", "ignorecase":
+			reFlags += "i"
+		case "m", "multiline":
+			reFlags += "m"
+		case "s", "dotall":
+			reFlags += "s"
+		default:
+			return nil, fmt.Errorf("%s: unsupported modifier %s", key, m)
+		}
+	}
+	if op == "exists" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s: exists must be true or false", key)
+		}
+		f.Exists = &b
+		return f, nil
+	}
+	if op == "re" && reFlags != "" {
+		transforms = append(transforms, "(?"+reFlags+")")
+	}
+	if op == "" {
+		op = "eq"
+	}
+	values, err := newSigmaValues(v, op, cased, transforms)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	f.Values = values
+	return f, nil
+}
+
+// newSigmaValues : 値かリストを比較する値にする。nullは値がない時に一致する
+func newSigmaValues(v interface{}, op string, cased bool, transforms []string) ([]*sigmaValueEnt, error) {
+	list := []interface{}{v}
+	if l, ok := v.([]interface{}); ok {
+		list = l
+	}
+	ret := []*sigmaValueEnt{}
+	for _, e := range list {
+		if e == nil {
+			ret = append(ret, &sigmaValueEnt{null: true})
+			continue
+		}
+		if _, ok := e.(map[string]interface{}); ok {
+			return nil, fmt.Errorf("invalid value type %T", e)
+		}
+		strs := []string{fmt.Sprint(e)}
+		c := cased
+		for _, t := range transforms {
+			switch t {
+			case "windash":
+				strs = getSigmaWindash(strs)
+			case "wide", "utf16le":
+				for i, s := range strs {
+					strs[i] = getUTF16LE(s)
+				}
+			case "base64":
+				for i, s := range strs {
+					strs[i] = base64.StdEncoding.EncodeToString([]byte(s))
+				}
+				c = true
+			case "base64offset":
+				n := []string{}
+				for _, s := range strs {
+					n = append(n, getSigmaBase64Offset(s)...)
+				}
+				strs = n
+				c = true
+			default:
+				// reのフラグ
+				for i, s := range strs {
+					strs[i] = t + s
+				}
+			}
+		}
+		for _, s := range strs {
+			sv, err := newSigmaValue(s, op, c)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, sv)
+		}
+	}
+	return ret, nil
+}
+
+func newSigmaValue(s, op string, cased bool) (*sigmaValueEnt, error) {
+	v := &sigmaValueEnt{op: op, cased: cased}
+	switch op {
+	case "re":
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		v.re = re
+		return v, nil
+	case "cidr":
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		v.ipnet = n
+		return v, nil
+	case "gt", "gte", "lt", "lte":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		v.num = f
+		return v, nil
+	case "contains":
+		s = "*" + s + "*"
+	case "startswith":
+		s = s + "*"
+	case "endswith":
+		s = "*" + s
+	}
+	return newSigmaPattern(s, cased)
+}
+
+// newSigmaPattern : 先頭と末尾の*以外にワイルドカードがなければ文字列で比較する
+// \*と\?と\\はエスケープ
+func newSigmaPattern(p string, cased bool) (*sigmaValueEnt, error) {
+	type item struct {
+		r    rune
+		wild bool
+	}
+	items := []item{}
+	rs := []rune(p)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		if r == '\\' && i+1 < len(rs) && (rs[i+1] == '*' || rs[i+1] == '?' || rs[i+1] == '\\') {
+			items = append(items, item{r: rs[i+1]})
+			i++
+			continue
+		}
+		items = append(items, item{r: r, wild: r == '*' || r == '?'})
+	}
+	prefix := false
+	suffix := false
+	for len(items) > 0 && items[0].wild && items[0].r == '*' {
+		prefix = true
+		items = items[1:]
+	}
+	for len(items) > 0 && items[len(items)-1].wild && items[len(items)-1].r == '*' {
+		suffix = true
+		items = items[:len(items)-1]
+	}
+	simple := true
+	lit := []rune{}
+	for _, it := range items {
+		if it.wild {
+			simple = false
+		}
+		lit = append(lit, it.r)
+	}
+	v := &sigmaValueEnt{cased: cased}
+	if simple {
+		v.s = string(lit)
+		if !cased {
+			v.s = strings.ToLower(v.s)
+		}
+		switch {
+		case prefix && suffix:
+			v.op = "contains"
+		case prefix:
+			v.op = "endswith"
+		case suffix:
+			v.op = "startswith"
+		default:
+			v.op = "eq"
+		}
+		return v, nil
+	}
+	re := "^"
+	if prefix {
+		re += ".*"
+	}
+	for _, it := range items {
+		switch {
+		case it.wild && it.r == '*':
+			re += ".*"
+		case it.wild:
+			re += "."
+		default:
+			re += regexp.QuoteMeta(string(it.r))
+		}
+	}
+	if suffix {
+		re += ".*"
+	}
+	re += "$"
+	if !cased {
+		re = "(?is)" + re
+	} else {
+		re = "(?s)" + re
+	}
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return nil, err
+	}
+	v.op = "re"
+	v.re = r
+	return v, nil
+}
+
+// getSigmaWindash : -で始まるオプションを/や全角のダッシュでも一致させる
+func getSigmaWindash(l []string) []string {
+	ret := []string{}
+	for _, s := range l {
+		for _, d := range []string{"-", "/", "–", "—", "―"} {
+			ret = append(ret, strings.ReplaceAll(s, "-", d))
+		}
+	}
+	return ret
+}
+
+func getUTF16LE(s string) string {
+	b := []byte{}
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return string(b)
+}
+
+// getSigmaBase64Offset : 位置によって変わる3通りのBase64
+func getSigmaBase64Offset(s string) []string {
+	ret := []string{}
+	start := []int{0, 2, 3}
+	end := []int{0, 3, 2}
+	for i := 0; i < 3; i++ {
+		b := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(" ", i) + s))
+		e := len(b)
+		if n := end[(len(s)+i)%3]; n > 0 {
+			e -= n
+		}
+		if start[i] < e {
+			ret = append(ret, b[start[i]:e])
+		}
+	}
+	return ret
+}
+
+func (v *sigmaValueEnt) match(s string, ok bool) bool {
+	if v.null {
+		return !ok || s == ""
+	}
+	if !ok {
+		return false
+	}
+	switch v.op {
+	case "re":
+		return v.re.MatchString(s)
+	case "cidr":
+		ip := net.ParseIP(strings.TrimPrefix(s, "::ffff:"))
+		return ip != nil && v.ipnet.Contains(ip)
+	case "gt", "gte", "lt", "lte":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false
+		}
+		switch v.op {
+		case "gt":
+			return f > v.num
+		case "gte":
+			return f >= v.num
+		case "lt":
+			return f < v.num
+		}
+		return f <= v.num
+	}
+	if !v.cased {
+		s = strings.ToLower(s)
+	}
+	switch v.op {
+	case "contains":
+		return strings.Contains(s, v.s)
+	case "startswith":
+		return strings.HasPrefix(s, v.s)
+	case "endswith":
+		return strings.HasSuffix(s, v.s)
+	}
+	return s == v.s
+}
+
+func (f *sigmaFieldEnt) match(ev *Event, alias map[string]string) bool {
+	if f.Field == "" {
+		// フィールド名がない時は全ての値と比較する
+		for _, v := range f.Values {
+			if !matchSigmaAnyValue(ev, v) {
+				if f.All {
+					return false
+				}
+				continue
+			}
+			if !f.All {
+				return true
+			}
+		}
+		return f.All
+	}
+	s, ok := getSigmaField(ev, alias, f.Field)
+	if f.Exists != nil {
+		return ok == *f.Exists
+	}
+	for _, v := range f.Values {
+		if v.match(s, ok) {
+			if !f.All {
+				return true
+			}
+		} else if f.All {
+			return false
+		}
+	}
+	return f.All && len(f.Values) > 0
+}
+
+func matchSigmaAnyValue(ev *Event, v *sigmaValueEnt) bool {
+	for _, d := range []*EventData{&ev.EventData, &ev.UserData} {
+		for _, s := range d.Values {
+			if v.match(s, true) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *sigmaSearchEnt) match(ev *Event, alias map[string]string) bool {
+	for _, v := range s.keywords {
+		if matchSigmaAnyValue(ev, v) {
+			return true
+		}
+	}
+	for _, m := range s.maps {
+		hit := true
+		for _, f := range m {
+			if !f.match(ev, alias) {
+				hit = false
+				break
+			}
+		}
+		if hit {
+			return true
+		}
+	}
+	return false
+}
+
+// getSigmaField : EventIDなどのSystemの項目とEventData,UserDataの値
+func getSigmaField(ev *Event, alias map[string]string, name string) (string, bool) {
+	switch name {
+	case "EventID":
+		return strconv.Itoa(ev.System.EventID), true
+	case "Channel":
+		return ev.System.Channel, true
+	case "Provider_Name":
+		return ev.System.Provider.Name, true
+	case "Computer":
+		return ev.System.Computer, true
+	case "Level":
+		return strconv.Itoa(ev.System.Level), true
+	}
+	if a, ok := alias[name]; ok {
+		name = a
+	}
+	if v, ok := ev.EventData.Values[name]; ok {
+		return v, true
+	}
+	v, ok := ev.UserData.Values[name]
+	return v, ok
+}
+
+// sigmaCondParser : selection and not 1 of filter_* のような条件を解析する
+// | count()などの集計とnearには対応しない
+type sigmaCondParser struct {
+	tokens []string
+	pos    int
+	names  []string
+}
+
+var reSigmaCondToken = regexp.MustCompile(`\(|\)|\||[^\s()|]+`)
+
+func parseSigmaCondition(s string, names []string) (sigmaCondFunc, error) {
+	p := &sigmaCondParser{
+		tokens: reSigmaCondToken.FindAllString(s, -1),
+		names:  names,
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		if p.tokens[p.pos] == "|" {
+			return nil, fmt.Errorf("aggregation is not supported")
+		}
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func (p *sigmaCondParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaCondParser) parseOr() (sigmaCondFunc, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		a := l
+		l = func(m func(string) bool) bool { return a(m) || r(m) }
+	}
+	return l, nil
+}
+
+func (p *sigmaCondParser) parseAnd() (sigmaCondFunc, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		a := l
+		l = func(m func(string) bool) bool { return a(m) && r(m) }
+	}
+	return l, nil
+}
+
+func (p *sigmaCondParser) parseNot() (sigmaCondFunc, error) {
+	if p.peek() == "not" {
+		p.pos++
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(m func(string) bool) bool { return !f(m) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sigmaCondParser) parsePrimary() (sigmaCondFunc, error) {
+	t := p.peek()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return f, nil
+	case "1", "any", "all":
+		p.pos++
+		if p.peek() != "of" {
+			return nil, fmt.Errorf("missing of after %s", t)
+		}
+		p.pos++
+		names, err := p.matchNames()
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		if t == "all" {
+			return func(m func(string) bool) bool {
+				for _, n := range names {
+					if !m(n) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(m func(string) bool) bool {
+			for _, n := range names {
+				if m(n) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case ")", "and", "or", "|":
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	name := p.tokens[p.pos]
+	p.pos++
+	for _, n := range p.names {
+		if n == name {
+			return func(m func(string) bool) bool { return m(name) }, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown search %s", name)
+}
+
+// matchNames : themは_で始まる名前を除く全ての検索条件
+func (p *sigmaCondParser) matchNames() ([]string, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	pattern := p.tokens[p.pos]
+	ret := []string{}
+	for _, n := range p.names {
+		if strings.EqualFold(pattern, "them") {
+			if !strings.HasPrefix(n, "_") {
+				ret = append(ret, n)
+			}
+		} else if ok, _ := path.Match(pattern, n); ok {
+			ret = append(ret, n)
+		}
+	}
+	if len(ret) < 1 {
+		return nil, fmt.Errorf("no search for %s", pattern)
+	}
+	return ret, nil
+}
+
+// getSource : イベントのチャネルとイベントIDに一致するlogsource
+func (r *sigmaRuleEnt) getSource(ev *Event) *sigmaSourceEnt {
+	for _, s := range r.sources {
+		if s.Channel != "" && !strings.EqualFold(s.Channel, ev.System.Channel) {
+			continue
+		}
+		if len(s.EventIDs) < 1 {
+			return s
+		}
+		for _, id := range s.EventIDs {
+			if id == ev.System.EventID {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// checkSigma : checkEventsの中から呼び出す
+func checkSigma(ev *Event, t time.Time) {
+	for _, r := range sigmaRules {
+		if src := r.match(ev); src != nil {
+			sendSigma(r, ev, src, t)
+		}
+	}
+}
+
+// match : 一致した時はイベントのlogsourceを返す
+func (r *sigmaRuleEnt) match(ev *Event) *sigmaSourceEnt {
+	src := r.getSource(ev)
+	if src == nil {
+		return nil
+	}
+	cache := make(map[string]bool)
+	hit := r.cond(func(name string) bool {
+		if v, ok := cache[name]; ok {
+			return v
+		}
+		v := r.search[name].match(ev, src.Alias)
+		cache[name] = v
+		return v
+	})
+	if !hit {
+		return nil
+	}
+	return src
+}
+
+// getSigmaSeverity : levelをsyslogのSeverityにする
+func getSigmaSeverity(level string) int {
+	switch level {
+	case "critical":
+		return 2
+	case "high":
+		return 3
+	case "medium":
+		return 4
+	case "low":
+		return 5
+	}
+	return 6
+}
+
+func sendSigma(r *sigmaRuleEnt, ev *Event, src *sigmaSourceEnt, t time.Time) {
+	r.Count++
+	sigmaCount.Add(1)
+	f := newSyslogFields("type", "Sigma", "id", r.ID, "title", r.Title, "level", r.Level,
+		"computer", ev.System.Computer, "channel", ev.System.Channel,
+		"eventID", ev.System.EventID, "recordID", ev.System.EventRecordID)
+	m := make(map[string]string)
+	for _, k := range r.Fields {
+		if v, ok := getSigmaField(ev, src.Alias, k); ok {
+			f = append(f, newSyslogFields(k, v)...)
+			m[k] = v
+		}
+	}
+	f = append(f, newSyslogFields("tags", strings.Join(r.Tags, ";"), "time", t.Format(time.RFC3339))...)
+	msg := f.String()
+	if debug {
+		log.Println(msg)
+	}
+	sendSyslog(&syslogEnt{
+		Severity: getSigmaSeverity(r.Level),
+		Time:     t,
+		Msg:      msg,
+		Fields:   f,
+	})
+	publishMQTT(&mqttSigmaDataEnt{
+		Time:     t.Format(time.RFC3339),
+		ID:       r.ID,
+		Title:    r.Title,
+		Level:    r.Level,
+		Computer: ev.System.Computer,
+		Channel:  ev.System.Channel,
+		EventID:  ev.System.EventID,
+		RecordID: ev.System.EventRecordID,
+		Tags:     r.Tags,
+		Fields:   m,
+	})
+}
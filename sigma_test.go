@@ -0,0 +1,315 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func newTestSigmaRule(s string) (*sigmaRuleEnt, error) {
+	var c sigmaRuleConfigEnt
+	if err := yaml.Unmarshal([]byte(s), &c); err != nil {
+		return nil, err
+	}
+	return newSigmaRule(&c)
+}
+
+func newTestEvent(channel string, eventID int, data map[string]string) *Event {
+	ev := &Event{}
+	ev.System.Channel = channel
+	ev.System.EventID = eventID
+	ev.System.Computer = "PC01"
+	ev.EventData.Values = make(map[string]string)
+	for k, v := range data {
+		ev.EventData.Keys = append(ev.EventData.Keys, k)
+		ev.EventData.Values[k] = v
+	}
+	return ev
+}
+
+func TestSigmaModifiers(t *testing.T) {
+	base := map[string]string{
+		"Image":       `C:\Windows\System32\cmd.exe`,
+		"CommandLine": `cmd.exe /c whoami /all`,
+		"User":        `CONTOSO\alice`,
+	}
+	tests := []struct {
+		name      string
+		detection string
+		data      map[string]string
+		want      bool
+	}{
+		{"eq ignore case", `Image: 'c:\windows\system32\CMD.EXE'`, nil, true},
+		{"eq not partial", `Image: cmd.exe`, nil, false},
+		{"wildcard *", `Image: '*\cmd.exe'`, nil, true},
+		{"wildcard ?", `Image: 'C:\Windows\System32\c?d.exe'`, nil, true},
+		{"escaped *", `CommandLine: 'echo \*'`, map[string]string{"CommandLine": "echo *"}, true},
+		{"escaped * not wildcard", `CommandLine: 'echo \*'`, map[string]string{"CommandLine": "echo x"}, false},
+		{"contains", `CommandLine|contains: WHOAMI`, nil, true},
+		{"startswith", `CommandLine|startswith: cmd.exe /c`, nil, true},
+		{"endswith", `Image|endswith: \powershell.exe`, nil, false},
+		{"list is or", `Image|endswith: ['\powershell.exe', '\cmd.exe']`, nil, true},
+		{"contains all", `CommandLine|contains|all: [whoami, /all]`, nil, true},
+		{"contains all miss", `CommandLine|contains|all: [whoami, /priv]`, nil, false},
+		{"re", `CommandLine|re: 'who[a-z]+ /all$'`, nil, true},
+		{"re cased", `CommandLine|re: WHOAMI`, nil, false},
+		{"re i", `CommandLine|re|i: WHOAMI`, nil, true},
+		{"cased", `CommandLine|contains|cased: WHOAMI`, nil, false},
+		{"cidr", `DestinationIp|cidr: 10.0.0.0/8`, map[string]string{"DestinationIp": "10.1.2.3"}, true},
+		{"cidr mapped ipv6", `DestinationIp|cidr: 10.0.0.0/8`, map[string]string{"DestinationIp": "::ffff:10.1.2.3"}, true},
+		{"cidr miss", `DestinationIp|cidr: 10.0.0.0/8`, map[string]string{"DestinationIp": "192.168.1.1"}, false},
+		{"gt", `DestinationPort|gt: 1024`, map[string]string{"DestinationPort": "4444"}, true},
+		{"lte", `DestinationPort|lte: 1024`, map[string]string{"DestinationPort": "4444"}, false},
+		{"gte not number", `DestinationPort|gte: 1`, map[string]string{"DestinationPort": "http"}, false},
+		{"exists", `User|exists: true`, nil, true},
+		{"not exists", `ParentImage|exists: false`, nil, true},
+		{"null no field", `ParentImage: null`, nil, true},
+		{"null empty", `ParentImage: null`, map[string]string{"ParentImage": ""}, true},
+		{"null has value", `Image: null`, nil, false},
+		{"windash", `CommandLine|windash|contains: ' -all'`, nil, true},
+		{"base64", `CommandLine|base64|contains: secret`, map[string]string{"CommandLine": "echo c2VjcmV0 | x"}, true},
+		{"base64offset", `CommandLine|base64offset|contains: whoami`,
+			map[string]string{"CommandLine": "powershell -e Y21kLmV4ZSAvYyB3aG9hbWkgL2FsbA=="}, true},
+		{"wide base64offset", `CommandLine|wide|base64offset|contains: Net.WebClient`,
+			map[string]string{"CommandLine": "powershell -enc SQBFAFgAIAAoAE4AZQB3AC0ATwBiAGoAZQBjAHQAIABOAGUAdAAuAFcAZQBiAEMAbABpAGUAbgB0ACkALgBEAG8AdwBuAGwAbwBhAGQAUwB0AHIAaQBuAGcAKAAxACkA"}, true},
+		{"EventID", `EventID: 1`, nil, true},
+		{"and in map", "Image|endswith: \\cmd.exe\n    User|endswith: \\bob", nil, false},
+		{"list of maps is or", "- Image|endswith: \\powershell.exe\n    - CommandLine|contains: whoami", nil, true},
+		{"keywords", "- mimikatz\n    - whoami", nil, true},
+		{"keywords miss", "- mimikatz", nil, false},
+	}
+	for _, tt := range tests {
+		r, err := newTestSigmaRule("title: test\nlogsource:\n  product: windows\ndetection:\n  selection:\n    " +
+			tt.detection + "\n  condition: selection\n")
+		if err != nil {
+			t.Errorf("%s err=%v", tt.name, err)
+			continue
+		}
+		data := make(map[string]string)
+		for k, v := range base {
+			data[k] = v
+		}
+		for k, v := range tt.data {
+			data[k] = v
+		}
+		ev := newTestEvent(sigmaSysmon, 1, data)
+		if got := r.match(ev) != nil; got != tt.want {
+			t.Errorf("%s=%v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSigmaCondition(t *testing.T) {
+	detection := `
+  sel1:
+    Image|endswith: \cmd.exe
+  sel2:
+    CommandLine|contains: whoami
+  filter_a:
+    User: SYSTEM
+  filter_b:
+    User: alice
+  _hidden:
+    User: bob
+`
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"sel1", true},
+		{"sel1 and sel2", true},
+		{"sel1 and filter_a", false},
+		{"sel1 and not filter_a", true},
+		{"filter_a or sel2", true},
+		{"not (sel1 or filter_a)", false},
+		{"(filter_a or filter_b) and sel2", true},
+		{"sel1 AND NOT filter_b", false},
+		{"not not sel1", true},
+		{"1 of filter_*", true},
+		{"any of filter_*", true},
+		{"all of filter_*", false},
+		{"all of sel*", true},
+		{"sel1 and not 1 of filter_*", false},
+		{"1 of them", true},
+		{"all of them", true},
+		{"all of them and _hidden", false},
+	}
+	ev := newTestEvent(sigmaSysmon, 1, map[string]string{
+		"Image":       `C:\Windows\System32\cmd.exe`,
+		"CommandLine": "whoami",
+		"User":        "alice",
+	})
+	for _, tt := range tests {
+		d := detection
+		if strings.HasPrefix(tt.cond, "all of them") {
+			// themは_で始まる検索を含まないのでfilter_aを除いて確認する
+			d = strings.ReplaceAll(d, "User: SYSTEM", "User: alice")
+		}
+		r, err := newTestSigmaRule("title: test\ndetection:" + d + "  condition: " + tt.cond + "\n")
+		if err != nil {
+			t.Errorf("%s err=%v", tt.cond, err)
+			continue
+		}
+		if got := r.match(ev) != nil; got != tt.want {
+			t.Errorf("%s=%v want %v", tt.cond, got, tt.want)
+		}
+	}
+}
+
+func TestSigmaConditionList(t *testing.T) {
+	r, err := newTestSigmaRule(`
+title: test
+detection:
+  sel1:
+    User: bob
+  sel2:
+    User: alice
+  condition:
+    - sel1
+    - sel2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.match(newTestEvent("Security", 4624, map[string]string{"User": "alice"})) == nil {
+		t.Error("condition list is not or")
+	}
+}
+
+func TestSigmaFieldMapping(t *testing.T) {
+	r, err := newTestSigmaRule(`
+title: office child shell
+logsource:
+  product: windows
+  category: process_creation
+detection:
+  selection:
+    ParentImage|endswith: \winword.exe
+    Image|endswith: \cmd.exe
+    User|contains: alice
+  condition: selection
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysmon := map[string]string{
+		"ParentImage": `C:\Program Files\Microsoft Office\WINWORD.EXE`,
+		"Image":       `C:\Windows\System32\cmd.exe`,
+		"User":        `CONTOSO\alice`,
+	}
+	security := map[string]string{
+		"ParentProcessName": `C:\Program Files\Microsoft Office\WINWORD.EXE`,
+		"NewProcessName":    `C:\Windows\System32\cmd.exe`,
+		"SubjectUserName":   "alice",
+	}
+	tests := []struct {
+		name    string
+		channel string
+		eventID int
+		data    map[string]string
+		want    string
+	}{
+		{"sysmon", sigmaSysmon, 1, sysmon, sigmaSysmon},
+		{"security 4688", "Security", 4688, security, "Security"},
+		{"security 4688 with sysmon names", "Security", 4688, sysmon, ""},
+		{"sysmon with security names", sigmaSysmon, 1, security, ""},
+		{"other event id", "Security", 4624, security, ""},
+		{"other channel", "System", 4688, security, ""},
+	}
+	for _, tt := range tests {
+		src := r.match(newTestEvent(tt.channel, tt.eventID, tt.data))
+		got := ""
+		if src != nil {
+			got = src.Channel
+		}
+		if got != tt.want {
+			t.Errorf("%s=%q want %q", tt.name, got, tt.want)
+		}
+	}
+	if len(r.Fields) != 3 {
+		t.Errorf("fields=%v", r.Fields)
+	}
+}
+
+func TestSigmaService(t *testing.T) {
+	r, err := newTestSigmaRule(`
+title: logon failed
+logsource:
+  product: windows
+  service: security
+detection:
+  selection:
+    EventID: 4625
+  condition: selection
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.match(newTestEvent("Security", 4625, nil)) == nil {
+		t.Error("no match security 4625")
+	}
+	if r.match(newTestEvent("System", 4625, nil)) != nil {
+		t.Error("match system 4625")
+	}
+}
+
+func TestSigmaRuleError(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"aggregation", "detection:\n  sel:\n    User: a\n  condition: sel | count() > 5\n"},
+		{"unknown search", "detection:\n  sel:\n    User: a\n  condition: sel and missing\n"},
+		{"no search for pattern", "detection:\n  sel:\n    User: a\n  condition: 1 of filter_*\n"},
+		{"missing of", "detection:\n  sel:\n    User: a\n  condition: 1 sel\n"},
+		{"missing )", "detection:\n  sel:\n    User: a\n  condition: (sel\n"},
+		{"unexpected end", "detection:\n  sel:\n    User: a\n  condition: sel and\n"},
+		{"no condition", "detection:\n  sel:\n    User: a\n"},
+		{"unsupported modifier", "detection:\n  sel:\n    User|foo: a\n  condition: sel\n"},
+		{"conflicting modifier", "detection:\n  sel:\n    User|contains|endswith: a\n  condition: sel\n"},
+		{"exists not bool", "detection:\n  sel:\n    User|exists: a\n  condition: sel\n"},
+		{"bad re", "detection:\n  sel:\n    User|re: '('\n  condition: sel\n"},
+		{"bad cidr", "detection:\n  sel:\n    Ip|cidr: 10.0.0.0\n  condition: sel\n"},
+		{"product", "logsource:\n  product: linux\ndetection:\n  sel:\n    User: a\n  condition: sel\n"},
+		{"category", "logsource:\n  category: proxy\ndetection:\n  sel:\n    User: a\n  condition: sel\n"},
+	}
+	for _, tt := range tests {
+		if _, err := newTestSigmaRule("title: test\n" + tt.rule); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestLoadSigmaRules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"good.yml": "title: good\ndetection:\n  sel:\n    User: a\n  condition: sel\n",
+		// action: globalの文書は読み飛ばして2つ目の文書を読み込む
+		"multi.yaml": "action: global\ntitle: multi\n---\ntitle: multi2\ndetection:\n  sel:\n    User: b\n  condition: sel\n",
+		"count.yml":  "title: count\ndetection:\n  sel:\n    User: a\n  condition: sel | count() > 5\n",
+		"readme.txt": "not rule",
+	}
+	for k, v := range files {
+		if err := os.WriteFile(filepath.Join(dir, k), []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sigmaDir = dir
+	defer func() {
+		sigmaDir = ""
+		sigmaRules = []*sigmaRuleEnt{}
+	}()
+	if err := loadSigmaRules(); err != nil {
+		t.Fatal(err)
+	}
+	titles := []string{}
+	for _, r := range sigmaRules {
+		titles = append(titles, r.Title)
+	}
+	if strings.Join(titles, ",") != "good,multi2" {
+		t.Errorf("rules=%v", titles)
+	}
+}
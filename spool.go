@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// spoolEnt : 送信できないメッセージを保存するディスク上のキュー
+// 1行に1件、JSONの文字列で追記して先頭から送信する
+type spoolEnt struct {
+	Name    string
+	path    string
+	mu      sync.Mutex
+	w       *os.File
+	r       *os.File
+	reader  *bufio.Reader
+	head    int64
+	size    int64
+	count   int
+	next    string
+	nextLen int64
+	Spooled atomic.Int64
+	Dropped atomic.Int64
+}
+
+var spoolList = []*spoolEnt{}
+var spoolListMu sync.Mutex
+
+// sendDropped : スプールせずに捨てたメッセージの数
+var sendDropped atomic.Int64
+
+// newSpool : スプールのディレクトリを指定しない時はnilを返す
+func newSpool(name string) *spoolEnt {
+	if spoolDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		log.Printf("spool err=%v", err)
+		return nil
+	}
+	s := &spoolEnt{
+		Name: name,
+		path: filepath.Join(spoolDir, getSpoolFileName(name)),
+	}
+	if err := s.open(); err != nil {
+		log.Printf("spool %s err=%v", name, err)
+		return nil
+	}
+	if s.count > 0 {
+		log.Printf("spool %s has %d messages", name, s.count)
+	}
+	spoolListMu.Lock()
+	spoolList = append(spoolList, s)
+	spoolListMu.Unlock()
+	return s
+}
+
+func getSpoolFileName(name string) string {
+	r := strings.NewReplacer(":", "_", "/", "_", "\\", "_", "[", "", "]", "")
+	return r.Replace(name) + ".spool"
+}
+
+// open : 前回送信できなかったメッセージも数える
+func (s *spoolEnt) open() error {
+	w, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	s.head = 0
+	s.size = 0
+	s.count = 0
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(w)
+	for {
+		l, err := br.ReadBytes('\n')
+		if len(l) > 0 && l[len(l)-1] == '\n' {
+			s.size += int64(len(l))
+			s.count++
+		}
+		if err != nil {
+			break
+		}
+	}
+	// 途中で書き込みが止まった行は捨てる
+	return w.Truncate(s.size)
+}
+
+// Len : スプールに残っている数
+func (s *spoolEnt) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Push : 上限を超える時は古いものから捨てる
+func (s *spoolEnt) Push(msg string) {
+	j, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	j = append(j, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := int64(spoolSize) * 1024 * 1024
+	if s.size-s.head+int64(len(j)) > limit {
+		s.compact(s.size-s.head+int64(len(j))-limit, nil)
+	}
+	if _, err := s.w.Write(j); err != nil {
+		log.Printf("spool %s err=%v", s.Name, err)
+		sendDropped.Add(1)
+		return
+	}
+	s.size += int64(len(j))
+	s.count++
+	s.Spooled.Add(1)
+}
+
+// Peek : 先頭のメッセージを返す。送信できたらPopで削除する
+func (s *spoolEnt) Peek() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextLen > 0 {
+		return s.next, true
+	}
+	if s.count < 1 {
+		return "", false
+	}
+	if s.r == nil {
+		r, err := os.Open(s.path)
+		if err != nil {
+			log.Printf("spool %s err=%v", s.Name, err)
+			return "", false
+		}
+		if _, err := r.Seek(s.head, io.SeekStart); err != nil {
+			r.Close()
+			return "", false
+		}
+		s.r = r
+		s.reader = bufio.NewReader(r)
+	}
+	l, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		s.closeReader()
+		return "", false
+	}
+	if err := json.Unmarshal(l, &s.next); err != nil {
+		// 壊れた行は読み飛ばす
+		log.Printf("spool %s err=%v", s.Name, err)
+		s.head += int64(len(l))
+		s.count--
+		s.Dropped.Add(1)
+		return "", false
+	}
+	s.nextLen = int64(len(l))
+	return s.next, true
+}
+
+// Pop : Peekしたメッセージを削除する
+func (s *spoolEnt) Pop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nextLen < 1 {
+		return
+	}
+	s.head += s.nextLen
+	s.count--
+	s.next = ""
+	s.nextLen = 0
+	if s.count < 1 {
+		// 全て送信したらファイルを空にする
+		s.closeReader()
+		if err := s.w.Truncate(0); err != nil {
+			log.Printf("spool %s err=%v", s.Name, err)
+		}
+		s.head = 0
+		s.size = 0
+	} else if s.head > 1024*1024 && s.head > s.size/2 {
+		s.compact(0, nil)
+	}
+}
+
+func (s *spoolEnt) closeReader() {
+	if s.r != nil {
+		s.r.Close()
+	}
+	s.r = nil
+	s.reader = nil
+}
+
+// PushFront : 送信待ちだったメッセージを先頭に戻す
+func (s *spoolEnt) PushFront(list []string) {
+	if len(list) < 1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compact(0, list)
+	s.Spooled.Add(int64(len(list)))
+}
+
+// compact : 送信済みとneedバイト分の古いメッセージを削除してファイルを作り直す
+// needを指定した時は上限を超えた分を古いものから捨てる。frontは先頭に追加する
+// Peekしたメッセージは送信中なので捨てずに先頭に残す
+func (s *spoolEnt) compact(need int64, front []string) {
+	s.closeReader()
+	r, err := os.Open(s.path)
+	if err != nil {
+		log.Printf("spool %s err=%v", s.Name, err)
+		return
+	}
+	if _, err := r.Seek(s.head, io.SeekStart); err != nil {
+		r.Close()
+		log.Printf("spool %s err=%v", s.Name, err)
+		return
+	}
+	br := bufio.NewReader(r)
+	var peeked []byte
+	if s.nextLen > 0 {
+		if peeked, err = br.ReadBytes('\n'); err != nil {
+			peeked = nil
+		}
+	}
+	skip := int64(0)
+	for skip < need {
+		l, err := br.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		skip += int64(len(l))
+		s.count--
+		s.Dropped.Add(1)
+	}
+	tmp := s.path + ".tmp"
+	w, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		r.Close()
+		log.Printf("spool %s err=%v", s.Name, err)
+		return
+	}
+	w.Write(peeked)
+	for _, m := range front {
+		if j, err := json.Marshal(m); err == nil {
+			w.Write(append(j, '\n'))
+		}
+	}
+	_, err = io.Copy(w, br)
+	w.Close()
+	// Windowsでは開いたままのファイルを置き換えられない
+	r.Close()
+	if err != nil {
+		log.Printf("spool %s err=%v", s.Name, err)
+		os.Remove(tmp)
+		return
+	}
+	s.w.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("spool %s err=%v", s.Name, err)
+	}
+	if err := s.open(); err != nil {
+		log.Printf("spool %s err=%v", s.Name, err)
+	}
+	if len(peeked) < 1 {
+		s.next = ""
+	}
+	s.nextLen = int64(len(peeked))
+}
+
+// getSpoolStats : スプールした数、残っている数、捨てた数
+func getSpoolStats() (int64, int64, int64) {
+	spoolListMu.Lock()
+	defer spoolListMu.Unlock()
+	var spooled, queued int64
+	dropped := sendDropped.Load()
+	for _, s := range spoolList {
+		spooled += s.Spooled.Load()
+		queued += int64(s.Len())
+		dropped += s.Dropped.Load()
+	}
+	return spooled, queued, dropped
+}
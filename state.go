@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateEnt : 再起動しても続きから読み込むための状態
+type stateEnt struct {
+	// LastTime : remote -> unix time
+	LastTime map[string]int64 `json:"last_time"`
+	// Bookmarks : remote -> channel -> EventRecordID
+	Bookmarks map[string]map[string]int64 `json:"bookmarks"`
+	// FirstSeen : kind -> key -> 初めて見た時刻
+	FirstSeen map[string]map[string]int64 `json:"first_seen"`
+}
+
+var state = stateEnt{
+	LastTime:  make(map[string]int64),
+	Bookmarks: make(map[string]map[string]int64),
+	FirstSeen: make(map[string]map[string]int64),
+}
+var stateMu sync.Mutex
+
+// getStatePath : 指定がなければ実行ファイルと同じ場所に保存する
+func getStatePath() string {
+	if stateFile != "" {
+		return stateFile
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "twwinlog_state.json"
+	}
+	return filepath.Join(filepath.Dir(exe), "twwinlog_state.json")
+}
+
+// loadState : 状態ファイルを読み込む
+func loadState() bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	path := getStatePath()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("loadState err=%v", err)
+		}
+		return false
+	}
+	s := stateEnt{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Printf("loadState err=%v path=%s", err, path)
+		return false
+	}
+	if s.LastTime != nil {
+		state.LastTime = s.LastTime
+	}
+	if s.Bookmarks != nil {
+		state.Bookmarks = s.Bookmarks
+	}
+	if s.FirstSeen != nil {
+		state.FirstSeen = s.FirstSeen
+	}
+	log.Printf("loadState path=%s", path)
+	return true
+}
+
+// saveState : 書き込み途中で停止しても壊れないように置き換える
+func saveState() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	b, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		log.Printf("saveState err=%v", err)
+		return
+	}
+	path := getStatePath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("saveState err=%v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("saveState err=%v", err)
+	}
+}
+
+func getBookmark(remote, channel string) (int64, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if m, ok := state.Bookmarks[remote]; ok {
+		id, ok := m[channel]
+		return id, ok
+	}
+	return 0, false
+}
+
+func setBookmark(remote, channel string, id int64) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	m, ok := state.Bookmarks[remote]
+	if !ok {
+		m = make(map[string]int64)
+		state.Bookmarks[remote] = m
+	}
+	m[channel] = id
+}
+
+// getBookmarks : チャネルごとのEventRecordIDのコピー
+func getBookmarks(remote string) map[string]int64 {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	ret := make(map[string]int64)
+	for k, v := range state.Bookmarks[remote] {
+		ret[k] = v
+	}
+	return ret
+}
+
+func getStateLastTime(remote string) (time.Time, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if i, ok := state.LastTime[remote]; ok {
+		return time.Unix(i, 0), true
+	}
+	return time.Time{}, false
+}
+
+func setStateLastTime(remote string, t time.Time) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state.LastTime[remote] = t.Unix()
+}
+
+// setFirstSeen : 初めて見た時はtrueを返す
+func setFirstSeen(kind, key string, ts int64) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	m, ok := state.FirstSeen[kind]
+	if !ok {
+		m = make(map[string]int64)
+		state.FirstSeen[kind] = m
+	}
+	if _, ok := m[key]; ok {
+		return false
+	}
+	m[key] = ts
+	return true
+}
+
+func getFirstSeen(kind, key string) (int64, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if m, ok := state.FirstSeen[kind]; ok {
+		ts, ok := m[key]
+		return ts, ok
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// レジストリを使わずに状態ファイルでブックマークを保存して読み込めること
+func TestStateBookmark(t *testing.T) {
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	defer func() { stateFile = "" }()
+	if loadState() {
+		t.Fatal("loaded not exist state file")
+	}
+	setBookmark("", "Security", 100)
+	setBookmark("", "System", 20)
+	setBookmark("dc01", "Security", 5)
+	setBookmark("", "Security", 120)
+	setFirstSeen("service", "dc01|svc", 1000)
+	saveState()
+	if _, err := os.Stat(stateFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("tmp file remains err=%v", err)
+	}
+	state = stateEnt{
+		LastTime:  make(map[string]int64),
+		Bookmarks: make(map[string]map[string]int64),
+		FirstSeen: make(map[string]map[string]int64),
+	}
+	if !loadState() {
+		t.Fatal("state file not loaded")
+	}
+	tests := []struct {
+		remote  string
+		channel string
+		id      int64
+		ok      bool
+	}{
+		{"", "Security", 120, true},
+		{"", "System", 20, true},
+		{"dc01", "Security", 5, true},
+		{"dc01", "System", 0, false},
+		{"dc02", "Security", 0, false},
+	}
+	for _, tt := range tests {
+		id, ok := getBookmark(tt.remote, tt.channel)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("%s/%s=%d,%v want %d,%v", tt.remote, tt.channel, id, ok, tt.id, tt.ok)
+		}
+	}
+	if m := getBookmarks("dc01"); len(m) != 1 || m["Security"] != 5 {
+		t.Errorf("bookmarks=%v", m)
+	}
+	if ts, ok := getFirstSeen("service", "dc01|svc"); !ok || ts != 1000 {
+		t.Errorf("firstSeen=%d,%v", ts, ok)
+	}
+	if setFirstSeen("service", "dc01|svc", 2000) {
+		t.Error("setFirstSeen returns true for known key")
+	}
+}
+
+func TestLoadBrokenState(t *testing.T) {
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	defer func() { stateFile = "" }()
+	if err := os.WriteFile(stateFile, []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if loadState() {
+		t.Error("loaded broken state file")
+	}
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,62 +21,538 @@ type syslogEnt struct {
 	Time     time.Time
 	Severity int
 	Msg      string
+	Fields   syslogFields
 }
 
-var syslogCh = make(chan *syslogEnt, 2000)
-var syslogCount = 0
+// syslogKV : メッセージの項目。RFC 5424では構造化データになる
+type syslogKV struct {
+	Key   string
+	Value string
+}
 
-func startSyslog(ctx context.Context) {
-	dstList := strings.Split(syslogDst, ",")
-	dst := []net.Conn{}
-	for _, d := range dstList {
-		if !strings.Contains(d, ":") {
-			d += ":514"
+type syslogFields []syslogKV
+
+// newSyslogFields : "type", "Logon", "subject", subject, ...の順に指定する
+func newSyslogFields(kv ...interface{}) syslogFields {
+	f := syslogFields{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		f = append(f, syslogKV{Key: fmt.Sprint(kv[i]), Value: fmt.Sprint(kv[i+1])})
+	}
+	return f
+}
+
+// String : type=Logon,subject=...の形式
+func (f syslogFields) String() string {
+	a := []string{}
+	for _, kv := range f {
+		a = append(a, kv.Key+"="+kv.Value)
+	}
+	return strings.Join(a, ",")
+}
+
+func (f syslogFields) Get(key string) string {
+	for _, kv := range f {
+		if kv.Key == key {
+			return kv.Value
 		}
-		s, err := net.Dial("udp", d)
-		if err != nil {
-			log.Fatal(err)
+	}
+	return ""
+}
+
+var syslogCh = make(chan *syslogEnt, 2000)
+var syslogCount atomic.Int64
+
+// syslogStopped : 送信ループが終了したらcloseする
+var syslogStopped = make(chan struct{})
+
+// replaySendTimeout : リプレイ中に送信先が停止していても待ち続けない
+var replaySendTimeout = time.Second * 10
+
+// syslogReportCount : 前回のレポートまでに送信した数
+var syslogReportCount atomic.Int64
+
+// getSyslogSent : 前回のレポートから送信した数
+func getSyslogSent() int64 {
+	return syslogCount.Load() - syslogReportCount.Load()
+}
+
+// syslogFacilityNum : -syslogFacilityの値
+var syslogFacilityNum = 21
+
+var syslogFacilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// syslogDstEnt : syslogの送信先ごとの状態
+type syslogDstEnt struct {
+	Scheme    string
+	Addr      string
+	ch        chan string
+	conn      net.Conn
+	mu        sync.Mutex
+	Healthy   bool
+	LastError string
+	Sent      int
+	Dropped   int
+	spool     *spoolEnt
+}
+
+var syslogDstList = []*syslogDstEnt{}
+
+// syslogTLSConfig : checkSyslogParamsで作成したtls://の送信先の設定
+var syslogTLSConfig *tls.Config
+
+// setupSyslogDst : 送信先のリストはstartSyslogの前に作成して以後変更しない
+func setupSyslogDst() {
+	for _, d := range strings.Split(syslogDst, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
 		}
+		dst := newSyslogDst(d)
+		dst.spool = newSpool("syslog_" + dst.Scheme + "_" + dst.Addr)
+		syslogDstList = append(syslogDstList, dst)
+	}
+}
+
+func startSyslog(ctx context.Context) {
+	defer close(syslogStopped)
+	for _, dst := range syslogDstList {
+		go dst.run(ctx, syslogTLSConfig)
+		msg := fmt.Sprintf("start send syslog to %s://%s", dst.Scheme, dst.Addr)
 		sendSyslog(&syslogEnt{
+			Time:     time.Now(),
 			Severity: 6,
-			Msg:      fmt.Sprintf("start send syslog to %s", d),
+			Msg:      msg,
 		})
 		publishMQTT(&mqttMessageDataEnt{
 			Time:    time.Now().Format(time.RFC3339),
 			Level:   "INFO",
 			Type:    "System",
-			Message: fmt.Sprintf("start send syslog to %s", d),
+			Message: msg,
 		})
-		dst = append(dst, s)
 	}
 	host, err := os.Hostname()
 	if err != nil {
 		host = "localhost"
 	}
-	defer func() {
-		for _, d := range dst {
-			d.Close()
-		}
-	}()
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("stop syslog")
 			return
 		case l := <-syslogCh:
-			syslogCount++
-			s := fmt.Sprintf("<%d>%s %s twwinlog: %s", 21*8+l.Severity, l.Time.Format("2006-01-02T15:04:05-07:00"), host, l.Msg)
-			for _, d := range dst {
-				d.Write([]byte(s))
+			syslogCount.Add(1)
+			s := formatSyslog(l, host)
+			for _, d := range syslogDstList {
+				d.send(ctx, s)
+			}
+		}
+	}
+}
+
+// checkSyslogParams : 送信形式とファシリティを確認する
+func checkSyslogParams() error {
+	switch syslogFormat {
+	case "bsd", "rfc5424":
+	default:
+		return fmt.Errorf("syslogFormat must be bsd or rfc5424")
+	}
+	syslogFacilityNum = -1
+	for i, n := range syslogFacilityNames {
+		if strings.EqualFold(n, syslogFacility) {
+			syslogFacilityNum = i
+		}
+	}
+	if syslogFacilityNum < 0 {
+		i, err := strconv.Atoi(syslogFacility)
+		if err != nil || i < 0 || i >= len(syslogFacilityNames) {
+			return fmt.Errorf("syslogFacility must be 0-23 or name(local0...)")
+		}
+		syslogFacilityNum = i
+	}
+	// SD-IDはname@<private enterprise number>の形式
+	a := strings.Split(syslogSDID, "@")
+	if len(a) != 2 || a[0] == "" || len(syslogSDID) > 32 || sdName(syslogSDID) != syslogSDID {
+		return fmt.Errorf("syslogSDID must be name@<enterprise number>")
+	}
+	if _, err := strconv.Atoi(strings.Split(a[1], ".")[0]); err != nil {
+		return fmt.Errorf("syslogSDID must be name@<enterprise number>")
+	}
+	for _, d := range strings.Split(syslogDst, ",") {
+		if newSyslogDst(strings.TrimSpace(d)).Scheme != "tls" {
+			continue
+		}
+		c, err := getSyslogTLSConfig()
+		if err != nil {
+			return fmt.Errorf("tls %v", err)
+		}
+		syslogTLSConfig = c
+		break
+	}
+	return nil
+}
+
+// formatSyslog : BSD(RFC 3164)かRFC 5424の形式にする
+func formatSyslog(l *syslogEnt, host string) string {
+	pri := syslogFacilityNum*8 + l.Severity
+	if syslogFormat != "rfc5424" {
+		return fmt.Sprintf("<%d>%s %s twwinlog: %s", pri, l.Time.Format("2006-01-02T15:04:05-07:00"), host, l.Msg)
+	}
+	msgID := "-"
+	sd := "-"
+	msg := ""
+	if len(l.Fields) > 0 {
+		params := ""
+		for _, kv := range l.Fields {
+			if kv.Key == "type" {
+				msgID = sdName(kv.Value)
+				continue
+			}
+			params += fmt.Sprintf(` %s="%s"`, sdName(kv.Key), sdEscape(kv.Value))
+		}
+		if params != "" {
+			sd = "[" + syslogSDID + params + "]"
+		}
+	} else if l.Msg != "" {
+		msg = " " + l.Msg
+	}
+	return fmt.Sprintf("<%d>1 %s %s twwinlog %d %s %s%s",
+		pri, l.Time.Format("2006-01-02T15:04:05.000000Z07:00"), host, os.Getpid(), msgID, sd, msg)
+}
+
+// sdName : SD-NAMEに使えない文字を_にする
+func sdName(s string) string {
+	r := []byte{}
+	for i := 0; i < len(s) && len(r) < 32; i++ {
+		c := s[i]
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		r = append(r, c)
+	}
+	if len(r) < 1 {
+		return "-"
+	}
+	return string(r)
+}
+
+// sdEscape : PARAM-VALUEの",\,]をエスケープする
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// newSyslogDst : udp://,tcp://,tls://の形式。省略した時はudp
+func newSyslogDst(d string) *syslogDstEnt {
+	dst := &syslogDstEnt{
+		Scheme: "udp",
+		Addr:   d,
+		ch:     make(chan string, 2000),
+	}
+	if i := strings.Index(d, "://"); i > 0 {
+		dst.Scheme = strings.ToLower(d[:i])
+		dst.Addr = d[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(dst.Addr); err != nil {
+		switch dst.Scheme {
+		case "tls":
+			dst.Addr += ":6514"
+		default:
+			dst.Addr += ":514"
+		}
+	}
+	return dst
+}
+
+// send : 送信先が停止していても他の送信先を待たせない
+func (d *syslogDstEnt) send(ctx context.Context, s string) {
+	if isReplay() && d.spool == nil {
+		// リプレイ中は捨てずに送信を待つが、送信先が停止している時は待ち続けない
+		select {
+		case d.ch <- s:
+			return
+		default:
+		}
+		d.mu.Lock()
+		healthy := d.Healthy
+		d.mu.Unlock()
+		if !healthy {
+			d.drop()
+			return
+		}
+		select {
+		case d.ch <- s:
+		case <-ctx.Done():
+			d.drop()
+		case <-time.After(replaySendTimeout):
+			d.drop()
+			log.Printf("syslog %s://%s send timeout", d.Scheme, d.Addr)
+		}
+		return
+	}
+	// スプールに残っている間は順番を守るためスプールに追加する
+	if d.spool.Len() > 0 {
+		d.spool.Push(s)
+		return
+	}
+	select {
+	case d.ch <- s:
+	default:
+		if d.spool != nil {
+			d.spool.Push(s)
+			return
+		}
+		d.drop()
+		if debug {
+			log.Printf("syslog %s queue full, skipping message", d.Addr)
+		}
+	}
+}
+
+func (d *syslogDstEnt) drop() {
+	d.mu.Lock()
+	d.Dropped++
+	d.mu.Unlock()
+	sendDropped.Add(1)
+}
+
+// saveSpool : 停止する時に送信待ちのメッセージをスプールに保存する
+func (d *syslogDstEnt) saveSpool(pending string) {
+	if d.spool == nil {
+		return
+	}
+	list := []string{}
+	if pending != "" {
+		list = append(list, pending)
+	}
+	for len(d.ch) > 0 {
+		list = append(list, <-d.ch)
+	}
+	d.spool.PushFront(list)
+}
+
+func (d *syslogDstEnt) run(ctx context.Context, tlsConf *tls.Config) {
+	backoff := time.Second
+	pending := ""
+	fromSpool := false
+	defer func() {
+		if d.conn != nil {
+			d.conn.Close()
+		}
+		if fromSpool {
+			pending = ""
+		}
+		d.saveSpool(pending)
+	}()
+	for {
+		if d.conn == nil {
+			if err := d.connect(tlsConf); err != nil {
+				d.setHealth(false, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				// 再接続の間隔を最大1分まで延ばす
+				backoff *= 2
+				if backoff > time.Minute {
+					backoff = time.Minute
+				}
+				continue
+			}
+			backoff = time.Second
+			d.setHealth(true, nil)
+		}
+		if pending == "" {
+			fromSpool = false
+			select {
+			case pending = <-d.ch:
+			default:
+				if s, ok := d.spool.Peek(); ok {
+					pending = s
+					fromSpool = true
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case pending = <-d.ch:
+				case <-time.After(time.Second):
+					continue
+				}
+			}
+		}
+		if err := d.write(pending); err != nil {
+			d.setHealth(false, err)
+			if d.Scheme == "udp" {
+				// UDPは再送しない
+				d.drop()
+				if fromSpool {
+					d.spool.Pop()
+				}
+				pending = ""
+				continue
+			}
+			d.conn.Close()
+			d.conn = nil
+			continue
+		}
+		d.setHealth(true, nil)
+		d.mu.Lock()
+		d.Sent++
+		d.mu.Unlock()
+		if fromSpool {
+			d.spool.Pop()
+		}
+		pending = ""
+	}
+}
+
+func (d *syslogDstEnt) connect(tlsConf *tls.Config) error {
+	var err error
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	switch d.Scheme {
+	case "udp":
+		d.conn, err = dialer.Dial("udp", d.Addr)
+	case "tcp":
+		d.conn, err = dialer.Dial("tcp", d.Addr)
+	case "tls":
+		d.conn, err = tls.DialWithDialer(dialer, "tcp", d.Addr, tlsConf)
+	default:
+		err = fmt.Errorf("unknown scheme %s", d.Scheme)
+	}
+	return err
+}
+
+// write : TCPとTLSはRFC 6587のoctet-countingで送信する
+func (d *syslogDstEnt) write(s string) error {
+	if d.Scheme != "udp" {
+		s = fmt.Sprintf("%d %s", len(s), s)
+		d.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	}
+	_, err := d.conn.Write([]byte(s))
+	return err
+}
+
+func (d *syslogDstEnt) setHealth(ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ok != d.Healthy {
+		if ok {
+			log.Printf("syslog %s://%s connected", d.Scheme, d.Addr)
+		} else {
+			log.Printf("syslog %s://%s err=%v", d.Scheme, d.Addr, err)
+		}
+	}
+	d.Healthy = ok
+	if err != nil {
+		d.LastError = err.Error()
+	}
+}
+
+func getSyslogTLSConfig() (*tls.Config, error) {
+	return newTLSConfig(syslogCA, syslogCert, syslogKey, syslogPin)
+}
+
+// newTLSConfig : CAとサーバー証明書のフィンガープリントで送信先を確認する
+func newTLSConfig(ca, certFile, keyFile, fingerprint string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		b, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no cert in %s", ca)
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if fingerprint != "" {
+		pin := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) < 1 {
+				return fmt.Errorf("no server certificate")
+			}
+			h := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if hex.EncodeToString(h[:]) != pin {
+				return fmt.Errorf("server certificate fingerprint mismatch")
 			}
+			return nil
 		}
 	}
+	return conf, nil
+}
+
+// syslogDstStatsEnt : 送信先の状態
+type syslogDstStatsEnt struct {
+	Dst       string `json:"dst"`
+	Healthy   bool   `json:"healthy"`
+	LastError string `json:"last_error"`
+	Sent      int    `json:"sent"`
+	Dropped   int    `json:"dropped"`
+	Queue     int    `json:"queue"`
+}
+
+func getSyslogDstStats() []syslogDstStatsEnt {
+	ret := []syslogDstStatsEnt{}
+	for _, d := range syslogDstList {
+		d.mu.Lock()
+		s := syslogDstStatsEnt{
+			Dst:       d.Scheme + "://" + d.Addr,
+			Healthy:   d.Healthy,
+			LastError: d.LastError,
+			Sent:      d.Sent,
+			Dropped:   d.Dropped,
+		}
+		d.mu.Unlock()
+		s.Queue = len(d.ch) + d.spool.Len()
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// getSyslogQueueLen : 送信待ちのメッセージ数
+func getSyslogQueueLen() int {
+	n := len(syslogCh)
+	for _, d := range syslogDstList {
+		n += len(d.ch) + d.spool.Len()
+	}
+	return n
 }
 
 func sendSyslog(msg *syslogEnt) {
+	if msg.Msg == "" {
+		msg.Msg = msg.Fields.String()
+	}
+	if !filterSyslog(msg) {
+		return
+	}
+	if isReplay() {
+		// リプレイ中は捨てずに送信を待つ
+		select {
+		case syslogCh <- msg:
+		case <-syslogStopped:
+			sendDropped.Add(1)
+		case <-time.After(replaySendTimeout):
+			sendDropped.Add(1)
+			log.Println("syslog channel send timeout")
+		}
+		return
+	}
 	select {
 	case syslogCh <- msg:
 	default:
+		sendDropped.Add(1)
 		if debug {
 			log.Println("syslog channel full, skipping message")
 		}
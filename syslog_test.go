@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckSyslogParams(t *testing.T) {
+	defer func() {
+		syslogFormat = "bsd"
+		syslogFacility = "local5"
+		syslogSDID = "twwinlog@32473"
+		checkSyslogParams()
+	}()
+	tests := []struct {
+		format   string
+		facility string
+		sdid     string
+		num      int
+		ok       bool
+	}{
+		{"bsd", "local5", "twwinlog@32473", 21, true},
+		{"rfc5424", "AUTH", "twwinlog@32473", 4, true},
+		{"rfc5424", "authpriv", "ids@32473.1", 10, true},
+		{"rfc5424", "0", "twwinlog@32473", 0, true},
+		{"rfc5424", "23", "twwinlog@32473", 23, true},
+		{"rfc5424", "24", "twwinlog@32473", 0, false},
+		{"rfc5424", "local8", "twwinlog@32473", 0, false},
+		{"json", "local5", "twwinlog@32473", 0, false},
+		{"rfc5424", "local5", "twwinlog", 0, false},
+		{"rfc5424", "local5", "twwinlog@abc", 0, false},
+		{"rfc5424", "local5", "tw winlog@32473", 0, false},
+		{"rfc5424", "local5", "@32473", 0, false},
+	}
+	for _, tt := range tests {
+		syslogFormat = tt.format
+		syslogFacility = tt.facility
+		syslogSDID = tt.sdid
+		err := checkSyslogParams()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s %s err=%v", tt.format, tt.facility, tt.sdid, err)
+			continue
+		}
+		if tt.ok && syslogFacilityNum != tt.num {
+			t.Errorf("%s facility=%d want %d", tt.facility, syslogFacilityNum, tt.num)
+		}
+	}
+}
+
+func TestFormatSyslog(t *testing.T) {
+	defer func() {
+		syslogFormat = "bsd"
+		syslogFacilityNum = 21
+		syslogSDID = "twwinlog@32473"
+	}()
+	tm := time.Date(2025, 1, 23, 8, 0, 0, 123456000, time.FixedZone("JST", 9*3600))
+	pid := os.Getpid()
+	tests := []struct {
+		name     string
+		format   string
+		facility int
+		msg      *syslogEnt
+		want     string
+	}{
+		{
+			"bsd", "bsd", 21,
+			&syslogEnt{Time: tm, Severity: 6, Msg: "type=Logon,target=bob"},
+			"<174>2025-01-23T08:00:00+09:00 PC01 twwinlog: type=Logon,target=bob",
+		},
+		{
+			"structured data", "rfc5424", 21,
+			&syslogEnt{Time: tm, Severity: 6, Fields: newSyslogFields("type", "Logon", "target", "bob@CONTOSO", "count", 3)},
+			fmt.Sprintf(`<174>1 2025-01-23T08:00:00.123456+09:00 PC01 twwinlog %d Logon [twwinlog@32473 target="bob@CONTOSO" count="3"]`, pid),
+		},
+		{
+			"escape", "rfc5424", 4,
+			&syslogEnt{Time: tm, Severity: 2, Fields: newSyslogFields("type", "Alert", "commandLine", `cmd /c "echo [a]" \\srv\x`)},
+			fmt.Sprintf(`<34>1 2025-01-23T08:00:00.123456+09:00 PC01 twwinlog %d Alert [twwinlog@32473 commandLine="cmd /c \"echo [a\]\" \\\\srv\\x"]`, pid),
+		},
+		{
+			"sd name", "rfc5424", 0,
+			&syslogEnt{Time: tm, Severity: 0, Fields: newSyslogFields("type", "Sigma Rule", "a b=c]\"", "x")},
+			fmt.Sprintf(`<0>1 2025-01-23T08:00:00.123456+09:00 PC01 twwinlog %d Sigma_Rule [twwinlog@32473 a_b_c__="x"]`, pid),
+		},
+		{
+			"type only", "rfc5424", 23,
+			&syslogEnt{Time: tm, Severity: 7, Fields: newSyslogFields("type", "Stats")},
+			fmt.Sprintf(`<191>1 2025-01-23T08:00:00.123456+09:00 PC01 twwinlog %d Stats -`, pid),
+		},
+		{
+			"message", "rfc5424", 21,
+			&syslogEnt{Time: tm, Severity: 6, Msg: "start send syslog"},
+			fmt.Sprintf(`<174>1 2025-01-23T08:00:00.123456+09:00 PC01 twwinlog %d - - start send syslog`, pid),
+		},
+	}
+	for _, tt := range tests {
+		syslogFormat = tt.format
+		syslogFacilityNum = tt.facility
+		if got := formatSyslog(tt.msg, "PC01"); got != tt.want {
+			t.Errorf("%s\n got=%s\nwant=%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSdEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`abc`, `abc`},
+		{`"`, `\"`},
+		{`\`, `\\`},
+		{`]`, `\]`},
+		{`C:\a "b" [c]`, `C:\\a \"b\" [c\]`},
+	}
+	for _, tt := range tests {
+		if got := sdEscape(tt.in); got != tt.want {
+			t.Errorf("%s=%s want %s", tt.in, got, tt.want)
+		}
+	}
+}
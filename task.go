@@ -1,9 +1,9 @@
-//go:build windows
-
 package main
 
 import (
+	"encoding/xml"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"sync"
@@ -11,9 +11,14 @@ import (
 )
 
 type taskEnt struct {
+	Action    string
 	Subject   string
 	Computer  string
 	TaskName  string
+	Command   string
+	Arguments string
+	Triggers  string
+	RunAs     string
 	Count     int
 	FirstTime int64
 	LastTime  int64
@@ -24,61 +29,162 @@ type taskEnt struct {
 // <Data Name="SubjectUserName">dadmin</Data>
 // <Data Name="SubjectDomainName">CONTOSO</Data>
 // <Data Name="TaskName">\\Microsoft\\StartListener</Data>
+// <Data Name="TaskContent"><?xml version="1.0" encoding="UTF-16"?><Task ...>...</Task></Data>
+// 4702はTaskContentNew
+
+// taskContentEnt : TaskContentのXML
+type taskContentEnt struct {
+	Triggers struct {
+		List []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"Triggers"`
+	Principals struct {
+		Principal []struct {
+			UserID  string `xml:"UserId"`
+			GroupID string `xml:"GroupId"`
+		} `xml:"Principal"`
+	} `xml:"Principals"`
+	Actions struct {
+		Exec []struct {
+			Command   string `xml:"Command"`
+			Arguments string `xml:"Arguments"`
+		} `xml:"Exec"`
+		ComHandler []struct {
+			ClassID string `xml:"ClassId"`
+		} `xml:"ComHandler"`
+	} `xml:"Actions"`
+}
 
-func (e *taskEnt) String() string {
-	return fmt.Sprintf("type=Task,subject=%s,taskname=%s,computer=%s,count=%d,ft=%s,lt=%s",
-		e.Subject, e.TaskName, e.Computer, e.Count,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339),
+func (e *taskEnt) Fields() syslogFields {
+	return newSyslogFields("type", "Task", "action", e.Action, "subject", e.Subject, "taskname", e.TaskName, "computer", e.Computer,
+		"command", e.Command, "arguments", e.Arguments, "triggers", e.Triggers, "runAs", e.RunAs,
+		"count", e.Count,
+		"ft", time.Unix(e.FirstTime, 0).Format(time.RFC3339),
+		"lt", time.Unix(e.LastTime, 0).Format(time.RFC3339),
 	)
 }
 
 var taskMap sync.Map
 
-func updateTask(s *System, l string, t time.Time) {
-	subjectUserName := getEventData(reSubjectUserName, l)
-	subjectDomainName := getEventData(reSubjectDomainName, l)
-	taskName := getEventData(reTaskName, l)
+func updateTask(ev *Event, t time.Time) {
+	subjectUserName := ev.Get("SubjectUserName")
+	subjectDomainName := ev.Get("SubjectDomainName")
+	taskName := ev.Get("TaskName")
+	action := getTaskAction(ev.System.EventID)
+	content := ev.Get("TaskContent")
+	if content == "" {
+		content = ev.Get("TaskContentNew")
+	}
+	tc := parseTaskContent(content)
 	ts := t.Unix()
 	subject := fmt.Sprintf("%s@%s", subjectUserName, subjectDomainName)
-	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s", taskName, s.Computer, subject))
+	id := strings.ToUpper(fmt.Sprintf("%s:%s:%s:%s", action, taskName, ev.System.Computer, subject))
 	if v, ok := taskMap.Load(id); ok {
 		if e, ok := v.(*taskEnt); ok {
 			e.Count++
 			if e.LastTime < ts {
 				e.LastTime = ts
+				// 更新された時は最後のコマンドを送信する
+				e.setContent(tc)
 			}
 		}
 		return
 	}
 	e := &taskEnt{
+		Action:    action,
 		Count:     1,
 		TaskName:  taskName,
-		Computer:  s.Computer,
+		Computer:  ev.System.Computer,
 		Subject:   subject,
 		LastTime:  ts,
 		FirstTime: ts,
 	}
+	e.setContent(tc)
 	taskMap.Store(id, e)
 }
 
+func getTaskAction(id int) string {
+	switch id {
+	case 4698:
+		return "Created"
+	case 4699:
+		return "Deleted"
+	case 4700:
+		return "Enabled"
+	case 4701:
+		return "Disabled"
+	case 4702:
+		return "Updated"
+	}
+	return ""
+}
+
+// parseTaskContent : XMLのエンコーディングはUTF-16と書いてあるが変換済み
+func parseTaskContent(s string) *taskContentEnt {
+	if s == "" {
+		return nil
+	}
+	tc := new(taskContentEnt)
+	d := xml.NewDecoder(strings.NewReader(s))
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := d.Decode(tc); err != nil {
+		log.Printf("task content err=%v", err)
+		return nil
+	}
+	return tc
+}
+
+func (e *taskEnt) setContent(tc *taskContentEnt) {
+	if tc == nil {
+		return
+	}
+	e.Command = ""
+	e.Arguments = ""
+	if len(tc.Actions.Exec) > 0 {
+		e.Command = tc.Actions.Exec[0].Command
+		e.Arguments = tc.Actions.Exec[0].Arguments
+	} else if len(tc.Actions.ComHandler) > 0 {
+		e.Command = "COM:" + tc.Actions.ComHandler[0].ClassID
+	}
+	triggers := []string{}
+	for _, t := range tc.Triggers.List {
+		triggers = append(triggers, strings.TrimSuffix(t.XMLName.Local, "Trigger"))
+	}
+	e.Triggers = strings.Join(triggers, ";")
+	e.RunAs = ""
+	if len(tc.Principals.Principal) > 0 {
+		e.RunAs = tc.Principals.Principal[0].UserID
+		if e.RunAs == "" {
+			e.RunAs = tc.Principals.Principal[0].GroupID
+		}
+	}
+}
+
 func sendTask() {
 	taskMap.Range(func(k, v interface{}) bool {
 		if e, ok := v.(*taskEnt); ok {
 			if debug {
 				log.Printf("task id=%s,e=%v", k, e)
 			}
-			taskCount++
+			taskCount.Add(1)
 			sendSyslog(&syslogEnt{
 				Severity: 6,
 				Time:     time.Now(),
-				Msg:      e.String(),
+				Fields:   e.Fields(),
 			})
 			publishMQTT(&mqttTaskDataEnt{
 				Time:      time.Now().Format(time.RFC3339),
+				Action:    e.Action,
 				Subject:   e.Subject,
 				Computer:  e.Computer,
 				TaskName:  e.TaskName,
+				Command:   e.Command,
+				Arguments: e.Arguments,
+				Triggers:  e.Triggers,
+				RunAs:     e.RunAs,
 				Count:     e.Count,
 				FirstTime: time.Unix(e.FirstTime, 0).Format(time.RFC3339),
 				LastTime:  time.Unix(e.LastTime, 0).Format(time.RFC3339),
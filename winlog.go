@@ -8,95 +8,48 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
-	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"golang.org/x/sys/windows/registry"
 )
 
-var busy = false
-var lastTime = time.Now()
-var logonCount = 0
-var logoffCount = 0
-var logonFailedCount = 0
-var processCount = 0
-var kerberosCount = 0
-var taskCount = 0
-var accountCount = 0
-var privilegeCount = 0
-
-var reLogonType = regexp.MustCompile(`<Data Name='LogonType'>(\d+)</Data>`)
-var reSubjectUserName = regexp.MustCompile(`<Data Name='SubjectUserName'>([^<]+)</Data>`)
-var reSubjectDomainName = regexp.MustCompile(`<Data Name='SubjectDomainName'>([^<]+)</Data>`)
-var reTargetUserName = regexp.MustCompile(`<Data Name='TargetUserName'>([^<]+)</Data>`)
-var reTargetDomainName = regexp.MustCompile(`<Data Name='TargetDomainName'>([^<]+)</Data>`)
-var reIPAddress = regexp.MustCompile(`<Data Name='IpAddress'>([^<]+)</Data>`)
-var reSubStatus = regexp.MustCompile(`<Data Name='SubStatus'>([^<]+)</Data>`)
-var reTargetServerName = regexp.MustCompile(`<Data Name='TargetServerName'>([^<]+)</Data>`)
-var reTaskName = regexp.MustCompile(`<Data Name='TaskName'>([^<]+)</Data>`)
-var reServiceName = regexp.MustCompile(`<Data Name='ServiceName'>([^<]+)</Data>`)
-var reCertIssuerName = regexp.MustCompile(`<Data Name='CertIssuerName'>([^<]+)</Data>`)
-var reCertSerialNumber = regexp.MustCompile(`<Data Name='CertSerialNumber'>([^<]+)</Data>`)
-
-var reSubjectUserNameTag = regexp.MustCompile(`<SubjectUserName>([^<]+)</SubjectUserName>`)
-var reSubjectDomainNameTag = regexp.MustCompile(`<SubjectDomainName>([^<]+)</SubjectDomainName>`)
-var reSubjectUserSidTag = regexp.MustCompile(`<SubjectUserSid>([^<]+)</SubjectUserSid>`)
-
 const RegistryPath = "SOFTWARE\\Twise\\TWWINLOG"
 
-// <Data Name='SubjectUserName'>DESKTOP-T6L1D1U$</Data>
-// <Data Name='SubjectDomainName'>WORKGROUP</Data>
-// <Data Name='TargetUserName'>SYSTEM</Data>
-// <Data Name='TargetDomainName'>NT AUTHORITY</Data>
-// <Data Name='IpAddress'>-</Data>
-// <Data Name='SubStatus'>0xc0000064</Data>
-// <Data Name='TargetServerName'>WIN-ABEORAE1LF6.ymitest.local</Data>
-// <Data Name="TaskName">\\Microsoft\\StartListener</Data>
-
-var eventIDMap sync.Map
-
 // startWinlog : start monitor windows event log
 func startWinlog(ctx context.Context) {
-	param := remote
-	if param == "" {
-		param = "LOCAL"
-	}
-	getLastTime()
-	if debug {
-		lastTime = time.Now().Add(time.Hour * -12)
+	param := getRemoteParam()
+	loaded := !debug && loadState()
+	for _, r := range remoteList {
+		r.lastTime = time.Now()
+		if debug {
+			r.lastTime = time.Now().Add(time.Hour * -12)
+		} else if loaded {
+			if t, ok := getStateLastTime(r.key()); ok {
+				r.lastTime = t
+			}
+		} else {
+			getLastTime(r)
+		}
+		// 1台のPCの障害で他のPCの監視が止まらないように別々に処理する
+		go pollRemote(ctx, r)
 	}
 	sendMonitor(param)
-	timer := time.NewTicker(time.Second * time.Duration(syslogInterval))
+	changed := getIntervalChanged()
+	timer := time.NewTicker(time.Second * time.Duration(getInterval()))
 	defer timer.Stop()
-	total := 0
-	count := 0
 	for {
 		select {
+		case <-changed:
+			changed = getIntervalChanged()
+			timer.Reset(time.Second * time.Duration(getInterval()))
 		case <-timer.C:
-			count = checkWinlog()
-			saveLastTime()
-			total += count
-			msg := fmt.Sprintf("type=Stats,total=%d,count=%d,ps=%.2f,send=%d,param=%s",
-				total, count, float64(count)/float64(syslogInterval), syslogCount, param)
-			sendSyslog(&syslogEnt{
-				Time:     time.Now(),
-				Severity: 6,
-				Msg:      msg,
-			})
-			publishMQTT(&mqttStatsDataEnt{
-				Time:   time.Now().Format(time.RFC3339),
-				Total:  total,
-				Count:  count,
-				PS:     float64(count) / float64(syslogInterval),
-				Params: param,
-			})
 			sendReport(param)
-			log.Printf("total=%d,count=%d,syslog=%d,logon=%d,logoff=%d,logonFailed=%d,process=%d,task=%d,kerberos=%d,privilege=%d,account=%d",
-				total, count, syslogCount, logonCount, logoffCount, logonFailedCount, processCount, taskCount, kerberosCount,
-				privilegeCount, accountCount)
-			syslogCount = 0
+			sent := syslogCount.Load()
+			log.Printf("syslog=%d,logon=%d,logoff=%d,logonFailed=%d,process=%d,processInstance=%d,task=%d,kerberos=%d,privilege=%d,account=%d,session=%d,service=%d,group=%d,sigma=%d,alert=%d",
+				sent-syslogReportCount.Swap(sent), logonCount.Load(), logoffCount.Load(), logonFailedCount.Load(), processCount.Load(),
+				processInstanceCount.Load(), taskCount.Load(), kerberosCount.Load(), privilegeCount.Load(), accountCount.Load(),
+				sessionCount.Load(), serviceCount.Load(), groupCount.Load(), sigmaCount.Load(), alertCount.Load())
 			sendMonitor(param)
 		case <-ctx.Done():
 			log.Println("stop winlog")
@@ -105,274 +58,221 @@ func startWinlog(ctx context.Context) {
 	}
 }
 
-// getEventData : <EventData>タグ内から情報を取得する
-func getEventData(re *regexp.Regexp, l string) string {
-	if a := re.FindAllStringSubmatch(l, 1); len(a) > 0 && len(a[0]) > 1 && a[0][1] != "-" {
-		return a[0][1]
-	}
-	return ""
-}
-
-// syslogでレポートを送信する
-func sendReport(param string) {
-	if busy {
-		log.Printf("send report busy")
-		return
+// pollRemote : PCごとにイベントログを定期的に読み込む
+func pollRemote(ctx context.Context, r *remoteEnt) {
+	changed := getIntervalChanged()
+	timer := time.NewTicker(time.Second * time.Duration(getInterval()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-changed:
+			changed = getIntervalChanged()
+			timer.Reset(time.Second * time.Duration(getInterval()))
+		case <-timer.C:
+			st := time.Now()
+			count := r.checkWinlog(ctx)
+			r.pollDuration.Store(int64(time.Since(st)))
+			r.pollTime.Store(time.Now().Unix())
+			r.pollEvents.Add(int64(count))
+			if !debug {
+				setStateLastTime(r.key(), r.lastTime)
+				saveState()
+			}
+			r.total += count
+			sendStats(r.total, count, r.key())
+			log.Printf("remote=%s,total=%d,count=%d", r.key(), r.total, count)
+		case <-ctx.Done():
+			return
+		}
 	}
-	busy = true
-	sendEventID()
-	sendAccount()
-	sendKerberos()
-	sendPrivilege()
-	sendTask()
-	sendProcess()
-	sendMonitor(param)
-	busy = false
 }
 
-// System represents the Windows Event Log XML format.
-type System struct {
-	Provider struct {
-		Name string `xml:"Name,attr"`
-	}
-	EventID       int    `xml:"EventID"`
-	Level         int    `xml:"Level"`
-	EventRecordID int64  `xml:"EventRecordID"`
-	Channel       string `xml:"Channel"`
-	Computer      string `xml:"Computer"`
-	Security      struct {
-		UserID string `xml:"UserID,attr"`
-	}
-	TimeCreated struct {
-		SystemTime string `xml:"SystemTime,attr"`
+func (r *remoteEnt) checkWinlog(ctx context.Context) int {
+	if r.expanded.Load() == nil {
+		r.expandChannels(ctx)
 	}
-}
-
-func checkWinlog() int {
 	ret := 0
 	st := time.Now()
-	for _, c := range []string{"System", "Security", "Application"} {
-		ret += checkWinlogCh(c)
+	for _, c := range r.channels() {
+		if c.Enabled {
+			ret += r.checkWinlogCh(ctx, c)
+		}
 	}
 	if ret > 0 {
-		lastTime = st
+		r.lastTime = st
 	}
 	return ret
 }
 
-var reSystem = regexp.MustCompile(`<System.+System>`)
+// maxQueryEvents : 1回のwevtutilで取得するイベント数の上限
+const maxQueryEvents = 10000
 
-func checkWinlogCh(c string) int {
-	filter := fmt.Sprintf(`/q:*[System[TimeCreated[@SystemTime>'%s']]]`, lastTime.UTC().Format("2006-01-02T15:04:05"))
-	params := []string{"qe", c, filter}
-	if remote != "" {
-		params = append(params, "/r:"+remote)
-		params = append(params, "/u:"+user)
-		params = append(params, "/p:"+password)
-		if auth != "" {
-			params = append(params, "/a:"+auth)
-		}
-	}
+// checkWinlogCh : 前回のEventRecordIDより後のイベントを処理する
+func (r *remoteEnt) checkWinlogCh(ctx context.Context, c *channelEnt) int {
+	key := r.key()
 	ret := 0
-	out, err := exec.Command("wevtutil.exe", params...).Output()
-	if err != nil {
-		log.Printf("err=%v c=%s filter=%s", err, c, filter)
-		return 0
-	}
-	if len(out) < 5 {
-		return 0
-	}
-	s := new(System)
-	bSec := c == "Security"
-	for _, l := range strings.Split(strings.ReplaceAll(string(out), "\n", ""), "</Event>") {
-		l := strings.TrimSpace(l)
-		if len(l) < 10 {
-			continue
+	for {
+		id, ok := getBookmark(key, c.Name)
+		cond := fmt.Sprintf("EventRecordID>%d", id)
+		if !ok {
+			// ブックマークがない時は時刻で検索する
+			cond = fmt.Sprintf("TimeCreated[@SystemTime>'%s']", r.lastTime.UTC().Format("2006-01-02T15:04:05"))
 		}
-		lsys := reSystem.FindString(l)
-		err := xml.Unmarshal([]byte(lsys), s)
+		filter := "/q:" + c.buildQuery(cond)
+		out, err := r.execWevtutil(ctx, c.Name, filter, fmt.Sprintf("/c:%d", maxQueryEvents))
 		if err != nil {
-			log.Printf("xml err=%v", err)
-			continue
+			log.Printf("err=%v remote=%s c=%s filter=%s", err, key, c.Name, filter)
+			return ret
 		}
-		t := getEventTime(s.TimeCreated.SystemTime)
-		updateEventIDMap(s, t)
-		ret++
-		if !bSec {
-			continue
+		if len(out) < 5 {
+			break
+		}
+		n, lastID := checkEvents(string(out))
+		ret += n
+		if lastID > id {
+			setBookmark(key, c.Name, lastID)
 		}
-		switch s.EventID {
-		case 4624, 4625, 4648, 4634, 4647:
-			checkLogon(s, l, t)
-		case 4688, 4689:
-			updateProcess(s, l, t)
-		case 1102:
-			sendClearLog(l, t)
-		case 4698:
-			log.Printf("task in %v,%s", s, l)
-			updateTask(s, l, t)
-		case 4768, 4769:
-			updateKerberos(s, l, t)
-		case 4672, 4673:
-			updatePrivilege(s, l, t)
-		case 4720, 4722, 4723, 4724, 4725, 4726, 4738, 4740, 4767, 4781:
-			updateAccount(s, l, t)
+		if n < maxQueryEvents {
+			break
 		}
 	}
+	if ret == 0 {
+		r.checkClearLog(ctx, c.Name)
+	}
 	return ret
 }
 
-func getEventTime(s string) time.Time {
-	t, err := time.Parse(time.RFC3339Nano, s)
+// checkClearLog : ログがクリアされてEventRecordIDが戻った時はブックマークをリセットする
+func (r *remoteEnt) checkClearLog(ctx context.Context, c string) {
+	id, ok := getBookmark(r.key(), c)
+	if !ok || id < 1 {
+		return
+	}
+	out, err := r.execWevtutil(ctx, c, "/c:1", "/rd:true")
 	if err != nil {
-		log.Printf(" err=%v", err)
-		return time.Now()
+		log.Printf("err=%v remote=%s c=%s", err, r.key(), c)
+		return
+	}
+	ev := new(Event)
+	l := string(out)
+	if loc := reEventStart.FindStringIndex(l); loc != nil {
+		l = l[loc[0]:]
+	}
+	if err := xml.Unmarshal([]byte(l), ev); err != nil && len(out) > 5 {
+		log.Printf("xml err=%v", err)
+		return
+	}
+	if ev.System.EventRecordID < id {
+		log.Printf("reset bookmark remote=%s c=%s id=%d last=%d", r.key(), c, id, ev.System.EventRecordID)
+		setBookmark(r.key(), c, 0)
 	}
-	return t.Local()
 }
 
-type EventIDEnt struct {
-	Computer  string
-	Provider  string
-	Channel   string
-	EventID   int
-	Level     int
-	Total     int
-	Count     int
-	FirstTime int64
-	LastTime  int64
+// expandChannels : *と?を含むチャンネルをwevtutil elで展開する。失敗した時は次の読み込みでやり直す
+func (r *remoteEnt) expandChannels(ctx context.Context) {
+	list := r.configChannels()
+	found := false
+	for _, c := range list {
+		if isChannelPattern(c.Name) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		r.expanded.Store(&list)
+		return
+	}
+	out, err := r.runWevtutil(ctx, "el")
+	if err != nil {
+		log.Printf("err=%v remote=%s wevtutil el", err, r.key())
+		return
+	}
+	l := expandChannels(list, strings.Split(string(out), "\n"))
+	names := []string{}
+	for _, c := range l {
+		names = append(names, c.Name)
+	}
+	log.Printf("remote=%s channels=%s", r.key(), strings.Join(names, ";"))
+	r.expanded.Store(&l)
 }
 
-func (e *EventIDEnt) String() string {
-	return fmt.Sprintf("type=EventID,computer=%s,channel=%s,provider=%s,eventID=%d,total=%d,count=%d,ft=%s,lt=%s",
-		e.Computer, e.Channel, e.Provider, e.EventID, e.Total, e.Count,
-		time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-		time.Unix(e.LastTime, 0).Format(time.RFC3339))
+// execWevtutil : チャンネルのイベントを読み込む
+func (r *remoteEnt) execWevtutil(ctx context.Context, c string, opts ...string) ([]byte, error) {
+	return r.runWevtutil(ctx, append([]string{"qe", c}, opts...)...)
 }
 
-func updateEventIDMap(s *System, t time.Time) {
-	ts := t.Unix()
-	id := fmt.Sprintf("%s:%s:%d", s.Computer, s.Provider, s.EventID)
-	if v, ok := eventIDMap.Load(id); ok {
-		if e, ok := v.(*EventIDEnt); ok {
-			e.Count++
-			e.Total++
-			if e.LastTime < ts {
-				e.LastTime = ts
-			}
-			if s.Level != 0 && e.Level != 0 && e.Level > s.Level {
-				e.Level = s.Level
-			}
+// runWevtutil : 応答のないPCで止まらないように時間を制限する
+func (r *remoteEnt) runWevtutil(ctx context.Context, params ...string) ([]byte, error) {
+	if r.Host != "" {
+		params = append(params, "/r:"+r.Host)
+		params = append(params, "/u:"+r.User)
+		params = append(params, "/p:"+r.Password)
+		if r.Auth != "" {
+			params = append(params, "/a:"+r.Auth)
 		}
-		return
 	}
-	eventIDMap.Store(id, &EventIDEnt{
-		EventID:   s.EventID,
-		Level:     s.Level,
-		Computer:  s.Computer,
-		Channel:   s.Channel,
-		Provider:  s.Provider.Name,
-		Total:     1,
-		Count:     1,
-		FirstTime: ts,
-		LastTime:  ts,
-	})
+	timeout := time.Second * time.Duration(getInterval())
+	if timeout < time.Minute {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return exec.CommandContext(ctx, "wevtutil.exe", params...).Output()
 }
 
-func sendEventID() {
-	eventIDMap.Range(func(k, v interface{}) bool {
-		if e, ok := v.(*EventIDEnt); ok {
-			if e.Count < 1 {
-				return true
+// requeryWinlog : 指定した時間の範囲のイベントを読み直す。ブックマークは変更しない
+func requeryWinlog(ctx context.Context, remote, channel string, st, et time.Time) (int, error) {
+	ret := 0
+	found := false
+	for _, r := range remoteList {
+		if remote != "" && !strings.EqualFold(remote, r.key()) {
+			continue
+		}
+		for _, c := range r.channels() {
+			if !c.Enabled || (channel != "" && !strings.EqualFold(channel, c.Name)) {
+				continue
 			}
-			sv := 6
-			level := "INFO"
-			switch e.Level {
-			case 1:
-				sv = 2
-				level = "CRIT"
-			case 2:
-				sv = 3
-				level = "ERROR"
-			case 3:
-				sv = 4
-				level = "WARN"
+			found = true
+			var id int64
+			for {
+				cond := fmt.Sprintf("TimeCreated[@SystemTime>='%s' and @SystemTime<'%s'] and EventRecordID>%d",
+					st.UTC().Format("2006-01-02T15:04:05"), et.UTC().Format("2006-01-02T15:04:05"), id)
+				out, err := r.execWevtutil(ctx, c.Name, "/q:"+c.buildQuery(cond), fmt.Sprintf("/c:%d", maxQueryEvents))
+				if err != nil {
+					return ret, fmt.Errorf("remote=%s c=%s %v", r.key(), c.Name, err)
+				}
+				if len(out) < 5 {
+					break
+				}
+				n, lastID := checkEvents(string(out))
+				ret += n
+				if n < maxQueryEvents || lastID <= id {
+					break
+				}
+				id = lastID
 			}
-			msg := e.String()
-			sendSyslog(&syslogEnt{
-				Severity: sv,
-				Time:     time.Now(),
-				Msg:      msg,
-			})
-			publishMQTT(&mqttEventIDDataEnt{
-				Time:      time.Now().Format(time.RFC3339),
-				Computer:  e.Computer,
-				Provider:  e.Provider,
-				Channel:   e.Channel,
-				EventID:   e.EventID,
-				Level:     level,
-				Total:     e.Total,
-				Count:     e.Count,
-				FirstTime: time.Unix(e.FirstTime, 0).Format(time.RFC3339),
-				LastTime:  time.Unix(e.LastTime, 0).Format(time.RFC3339),
-			})
-			e.Count = 0
 		}
-		return true
-	})
-}
-
-func sendClearLog(l string, t time.Time) {
-	subjectUserName := getEventData(reSubjectUserNameTag, l)
-	subjectDomainName := getEventData(reSubjectDomainNameTag, l)
-	subjectUserSid := getEventData(reSubjectUserSidTag, l)
-	msg := fmt.Sprintf("type=ClearLog,subject=%s@%s,sid=%s",
-		subjectUserName, subjectDomainName, subjectUserSid)
-	sendSyslog(&syslogEnt{
-		Severity: 2,
-		Time:     t,
-		Msg:      msg,
-	})
-	publishMQTT(&mqttMessageDataEnt{
-		Time:    time.Now().Format(time.RFC3339),
-		Level:   "CRIT",
-		Type:    "ClearLog",
-		Message: msg,
-	})
+	}
+	if !found {
+		return 0, fmt.Errorf("no remote or channel")
+	}
+	log.Printf("requery remote=%s channel=%s start=%v end=%v count=%d", remote, channel, st, et, ret)
+	return ret, nil
 }
 
-// getLastTime from registry
-func getLastTime() {
+// getLastTime : 以前のバージョンがレジストリに保存した時刻から開始する
+func getLastTime(r *remoteEnt) {
 	k, err := registry.OpenKey(registry.LOCAL_MACHINE, RegistryPath, registry.QUERY_VALUE)
 	if err != nil {
 		log.Printf("getLastTime err=%v", err)
 		return
 	}
 	defer k.Close()
-	regKey := "LOCAL"
-	if remote != "" {
-		regKey = remote
-	}
-	i, _, err := k.GetIntegerValue(regKey)
+	i, _, err := k.GetIntegerValue(r.key())
 	if err != nil {
 		log.Printf("getLastTime err=%v", err)
 		return
 	}
-	lastTime = time.Unix(int64(i), 0)
-	log.Printf("lastTime=%v", lastTime)
-}
-
-func saveLastTime() {
-	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, RegistryPath, registry.ALL_ACCESS)
-	if err != nil {
-		log.Printf("saveLastTime err=%v", err)
-	}
-	defer k.Close()
-	regKey := "LOCAL"
-	if remote != "" {
-		regKey = remote
-	}
-	if err = k.SetQWordValue(regKey, uint64(lastTime.Unix())); err != nil {
-		log.Printf("saveLastTime err=%v", err)
-	}
+	r.lastTime = time.Unix(int64(i), 0)
+	log.Printf("remote=%s lastTime=%v", r.key(), r.lastTime)
 }